@@ -0,0 +1,589 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// archiveStats - result of archiving of dir
+type archiveStats struct {
+	files  int
+	bytes  int64
+	errors []string // per-file errors, archive is written without these files
+	sha256 string   // checksum of archive file
+	size   int64    // size of archive file, sum of volumes
+	parts  int      // number of volumes, 0 - single file
+}
+
+// default exclude patterns of archives
+var defaultExcludes = []string{"*.zfs*"}
+
+// archive formats and extensions of archive files
+var archiveExts = map[string]string{
+	"zip":     ".zip",
+	"tar.gz":  ".tar.gz",
+	"tar.zst": ".tar.zst",
+}
+
+// external commands of archive formats
+var archiveTools = map[string]string{
+	"tar.zst": "zstd",
+}
+
+// archiveDir writes 'srcDir' to archive file of 'format',
+// encrypted with gpg for OpenPGP public keys 'recipients' (files in cfgPath).
+// With 'volumeSize' > 0 archive file is split to volumes 'fileName.001'...
+// and manifest 'fileName.parts'. With 'include' only selected files are written.
+// Names in archive are paths under 'nameDir' without leading '/', like 'zip -r nameDir'
+func archiveDir(format, srcDir, nameDir, fileName, logFileName string,
+	excludes, recipients []string, volumeSize int64,
+	include func(p string, info os.FileInfo) bool) (archiveStats, error) {
+	var stats archiveStats
+	if _, ok := archiveExts[format]; !ok {
+		return stats, fmt.Errorf("unknown archive format '%s'", format)
+	}
+	logFile, err := os.Create(logFileName)
+	if err != nil {
+		return stats, err
+	}
+	defer logFile.Close()
+	var file io.WriteCloser
+	volumes := &volumeWriter{fileName: fileName, size: volumeSize}
+	if volumeSize > 0 {
+		file = volumes
+	} else {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return stats, err
+		}
+		file = f
+	}
+	// partial volumes of failed run are removed, manifest is not written
+	done := false
+	defer func() {
+		file.Close()
+		if !done && volumeSize > 0 {
+			volumes.remove()
+		}
+	}()
+	buf := bufio.NewWriterSize(file, 1024*1024)
+	// checksum of archive file
+	hash := sha256.New()
+	fileWriter := io.MultiWriter(buf, hash)
+	var w io.Writer = fileWriter
+	// encrypt: archive | gpg > file
+	var gpg *exec.Cmd
+	var gpgIn io.WriteCloser
+	var gpgErr bytes.Buffer
+	if len(recipients) > 0 {
+		gpgHome, err := newGpgHome()
+		if err != nil {
+			return stats, err
+		}
+		defer os.RemoveAll(gpgHome)
+		args := []string{"--trust-model", "always", "--compress-algo", "none", "--encrypt"}
+		for _, r := range recipients {
+			args = append(args, "--recipient-file", filepath.Join(cfgPath, r))
+		}
+		gpg = gpgCommand(gpgHome, args...)
+		gpg.Stdout = fileWriter
+		gpg.Stderr = &gpgErr
+		if gpgIn, err = gpg.StdinPipe(); err != nil {
+			return stats, err
+		}
+		if err := gpg.Start(); err != nil {
+			return stats, err
+		}
+		w = gpgIn
+	}
+	switch format {
+	case "zip":
+		stats, err = zipDir(w, srcDir, nameDir, logFile, excludes, include)
+	case "tar.gz", "tar.zst":
+		stats, err = tarDir(w, srcDir, nameDir, logFile, excludes, include, strings.TrimPrefix(format, "tar."))
+	}
+	if gpg != nil {
+		gpgIn.Close()
+		if waitErr := gpg.Wait(); waitErr != nil && err == nil {
+			err = fmt.Errorf("gpg: %s, %s", strings.TrimSpace(gpgErr.String()), waitErr)
+		}
+	}
+	if err != nil {
+		return stats, err
+	}
+	if err := buf.Flush(); err != nil {
+		return stats, err
+	}
+	if err := file.Close(); err != nil {
+		return stats, err
+	}
+	if volumeSize > 0 {
+		if err := volumes.writeManifest(); err != nil {
+			return stats, err
+		}
+		stats.size = volumes.total
+		stats.parts = len(volumes.parts)
+	} else if fstat, err := os.Stat(fileName); err == nil {
+		stats.size = fstat.Size()
+	}
+	stats.sha256 = hex.EncodeToString(hash.Sum(nil))
+	// sidecar in 'sha256sum' format
+	if err := ioutil.WriteFile(fileName+".sha256",
+		[]byte(stats.sha256+"  "+filepath.Base(fileName)+"\n"), 0644); err != nil {
+		return stats, err
+	}
+	done = true
+	return stats, nil
+}
+
+// volumeWriter writes stream to numbered files 'fileName.001', 'fileName.002'...
+// of 'size' bytes, manifest 'fileName.parts' with checksums of volumes is written
+// by writeManifest after successful run only
+type volumeWriter struct {
+	fileName string
+	size     int64
+	file     *os.File
+	hash     hash.Hash
+	written  int64    // bytes in current volume
+	total    int64    // bytes in all volumes
+	parts    []string // lines of manifest
+	closed   bool
+}
+
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if v.file == nil || v.written >= v.size {
+			if err := v.next(); err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if left := v.size - v.written; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		m, err := v.file.Write(chunk)
+		v.hash.Write(chunk[:m])
+		n += m
+		v.written += int64(m)
+		v.total += int64(m)
+		p = p[m:]
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// next closes current volume and creates the next one
+func (v *volumeWriter) next() error {
+	if err := v.closeVolume(); err != nil {
+		return err
+	}
+	file, err := os.Create(fmt.Sprintf("%s.%03d", v.fileName, len(v.parts)+1))
+	if err != nil {
+		return err
+	}
+	v.file = file
+	v.hash = sha256.New()
+	v.written = 0
+	return nil
+}
+
+func (v *volumeWriter) closeVolume() error {
+	if v.file == nil {
+		return nil
+	}
+	err := v.file.Close()
+	v.parts = append(v.parts, hex.EncodeToString(v.hash.Sum(nil))+"  "+filepath.Base(v.file.Name()))
+	v.file = nil
+	return err
+}
+
+// Close closes the last volume
+func (v *volumeWriter) Close() error {
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	return v.closeVolume()
+}
+
+// remove closes and removes all volumes of failed run
+func (v *volumeWriter) remove() {
+	v.Close()
+	for _, p := range v.parts {
+		os.Remove(filepath.Join(filepath.Dir(v.fileName), strings.Fields(p)[1]))
+	}
+}
+
+// writeManifest writes manifest of closed volumes in 'sha256sum' format
+func (v *volumeWriter) writeManifest() error {
+	var names []string
+	for _, p := range v.parts {
+		names = append(names, strings.Fields(p)[1])
+	}
+	manifest := fmt.Sprintf("# %d volumes of '%s', %d bytes\n# reassemble: cat %s > %s\n",
+		len(v.parts), filepath.Base(v.fileName), v.total,
+		strings.Join(names, " "), filepath.Base(v.fileName))
+	manifest += strings.Join(v.parts, "\n") + "\n"
+	return ioutil.WriteFile(v.fileName+".parts", []byte(manifest), 0644)
+}
+
+// archiveVolumes returns paths of volumes from manifest 'partsFile',
+// in order of manifest ('.1000' after '.999') and checksums by names
+func archiveVolumes(partsFile string) ([]string, map[string]string, error) {
+	data, err := ioutil.ReadFile(partsFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var volumes []string
+	sums := make(map[string]string)
+	for _, s := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(s, "#") {
+			continue
+		}
+		// '<sha256>  <name>'
+		if f := strings.SplitN(s, " ", 2); len(f) == 2 {
+			name := strings.TrimLeft(f[1], " *")
+			volumes = append(volumes, filepath.Join(filepath.Dir(partsFile), name))
+			sums[name] = f[0]
+		}
+	}
+	return volumes, sums, nil
+}
+
+// volumesReader reads volumes from manifest of volumes as one stream,
+// checksum of each volume is checked at its end
+type volumesReader struct {
+	volumes []string
+	sums    map[string]string
+	file    *os.File
+	hash    hash.Hash
+}
+
+// openVolumes returns reader of volumes from manifest 'partsFile'
+func openVolumes(partsFile string) (*volumesReader, error) {
+	volumes, sums, err := archiveVolumes(partsFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, fmt.Errorf("no volumes in '%s'", partsFile)
+	}
+	return &volumesReader{volumes: volumes, sums: sums}, nil
+}
+
+func (v *volumesReader) Read(p []byte) (int, error) {
+	for {
+		if v.file == nil {
+			if len(v.volumes) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(v.volumes[0])
+			if err != nil {
+				return 0, err
+			}
+			v.file, v.hash = file, sha256.New()
+		}
+		n, err := v.file.Read(p)
+		v.hash.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		name := filepath.Base(v.volumes[0])
+		v.file.Close()
+		v.file, v.volumes = nil, v.volumes[1:]
+		if hex.EncodeToString(v.hash.Sum(nil)) != v.sums[name] {
+			return n, fmt.Errorf("checksum mismatch of volume '%s'", name)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (v *volumesReader) Close() error {
+	if v.file == nil {
+		return nil
+	}
+	return v.file.Close()
+}
+
+// zipDir writes 'srcDir' to zip archive and file list to 'logFile'.
+// Symlinks are stored as links, with permissions and mtime of files.
+func zipDir(w io.Writer, srcDir, nameDir string, logFile io.Writer, excludes []string,
+	include func(p string, info os.FileInfo) bool) (archiveStats, error) {
+	var stats archiveStats
+	zw := zip.NewWriter(w)
+
+	logError := func(p string, err error) {
+		msg := fmt.Sprintf("%s: %s", p, err)
+		stats.errors = append(stats.errors, msg)
+		fmt.Fprintf(logFile, "  error: %s\n", msg)
+	}
+	walkErr := filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			logError(p, err)
+			return nil
+		}
+		if isExcluded(srcDir, p, excludes) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// incremental archive: not selected files are skipped, dirs are walked
+		if include != nil && p != srcDir && !include(p, info) {
+			return nil
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			logError(p, err)
+			return nil
+		}
+		hdr.Name = archiveName(srcDir, nameDir, p)
+		switch {
+		case info.IsDir():
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+			if _, err := zw.CreateHeader(hdr); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				logError(p, err)
+				return nil
+			}
+			hdr.Method = zip.Store
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, link); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				logError(p, err)
+				return nil
+			}
+			defer f.Close()
+			hdr.Method = zip.Deflate
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(w, f)
+			stats.bytes += n
+			if err != nil {
+				// entry in archive is truncated
+				logError(p, err)
+				return nil
+			}
+		default:
+			// sockets, devices, pipes
+			fmt.Fprintf(logFile, "  skip: %s (%s)\n", hdr.Name, info.Mode().Type())
+			return nil
+		}
+		stats.files++
+		fmt.Fprintf(logFile, "  adding: %s\n", hdr.Name)
+		return nil
+	})
+	if walkErr != nil {
+		return stats, walkErr
+	}
+	return stats, zw.Close()
+}
+
+// tarDir writes 'srcDir' to tar archive compressed with gzip or zstd (external),
+// with ownership, permissions, mtime, special files and extended attributes (ACL).
+func tarDir(w io.Writer, srcDir, nameDir string, logFile io.Writer, excludes []string,
+	include func(p string, info os.FileInfo) bool, compress string) (archiveStats, error) {
+	var stats archiveStats
+	var err error
+	// compressor
+	var cw io.WriteCloser
+	var zstd *exec.Cmd
+	var zstdErr bytes.Buffer
+	switch compress {
+	case "gz":
+		cw = gzip.NewWriter(w)
+	case "zst":
+		zstd = exec.Command("zstd", "-q", "-c")
+		zstd.Stdout = w
+		zstd.Stderr = &zstdErr
+		if cw, err = zstd.StdinPipe(); err != nil {
+			return stats, err
+		}
+		if err := zstd.Start(); err != nil {
+			return stats, err
+		}
+	default:
+		return stats, fmt.Errorf("unknown compress '%s'", compress)
+	}
+	tw := tar.NewWriter(cw)
+
+	logError := func(p string, err error) {
+		msg := fmt.Sprintf("%s: %s", p, err)
+		stats.errors = append(stats.errors, msg)
+		fmt.Fprintf(logFile, "  error: %s\n", msg)
+	}
+	walkErr := filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			logError(p, err)
+			return nil
+		}
+		if isExcluded(srcDir, p, excludes) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// incremental archive: not selected files are skipped, dirs are walked
+		if include != nil && p != srcDir && !include(p, info) {
+			return nil
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			fmt.Fprintf(logFile, "  skip: %s (%s)\n", p, info.Mode().Type())
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				logError(p, err)
+				return nil
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			logError(p, err)
+			return nil
+		}
+		hdr.Name = archiveName(srcDir, nameDir, p)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Format = tar.FormatPAX
+		// extended attributes: ACL and others, symlinks without xattrs
+		if link == "" {
+			if xattrs, err := listXattrs(p); err != nil {
+				logError(p, err)
+			} else if len(xattrs) > 0 {
+				hdr.PAXRecords = make(map[string]string)
+				for k, v := range xattrs {
+					hdr.PAXRecords["SCHILY.xattr."+k] = v
+				}
+			}
+		}
+		if !info.Mode().IsRegular() {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		} else {
+			f, err := os.Open(p)
+			if err != nil {
+				logError(p, err)
+				return nil
+			}
+			defer f.Close()
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			// size in header, file can't be skipped now
+			n, err := io.CopyN(tw, f, hdr.Size)
+			stats.bytes += n
+			if err != nil {
+				logError(p, err)
+				// pad entry with zeros up to size in header
+				if _, err := io.CopyN(tw, zeroReader{}, hdr.Size-n); err != nil {
+					return err
+				}
+				return nil
+			}
+		}
+		stats.files++
+		fmt.Fprintf(logFile, "  adding: %s\n", hdr.Name)
+		return nil
+	})
+	if walkErr != nil {
+		cw.Close()
+		if zstd != nil {
+			zstd.Wait()
+		}
+		return stats, walkErr
+	}
+	if err := tw.Close(); err != nil {
+		return stats, err
+	}
+	if err := cw.Close(); err != nil {
+		return stats, err
+	}
+	if zstd != nil {
+		if err := zstd.Wait(); err != nil {
+			return stats, fmt.Errorf("zstd: %s, %s", strings.TrimSpace(zstdErr.String()), err)
+		}
+	}
+	return stats, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// newGpgHome returns temporary GNUPGHOME, isolated from keyrings of user
+func newGpgHome() (string, error) {
+	return ioutil.TempDir("", "zyncnznap-gpg")
+}
+
+func gpgCommand(gpgHome string, arg ...string) *exec.Cmd {
+	return exec.Command("gpg", append([]string{"--homedir", gpgHome, "--batch", "--yes"}, arg...)...)
+}
+
+// archiveName returns name of 'p' from 'srcDir' in archive
+func archiveName(srcDir, nameDir, p string) string {
+	rel, err := filepath.Rel(srcDir, p)
+	if err != nil {
+		rel = p
+	}
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join(nameDir, rel)), "/")
+}
+
+// isExcluded matches exclude patterns with name and path relative to 'srcDir':
+// snapshot path changes with every snapshot, '/cache' and 'cache' are the same
+func isExcluded(srcDir, p string, excludes []string) bool {
+	rel, err := filepath.Rel(srcDir, p)
+	if err != nil {
+		rel = p
+	}
+	name := filepath.Base(p)
+	for _, pattern := range excludes {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(strings.TrimPrefix(pattern, "/"), rel); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 25)
+	tests := []struct {
+		size    int64
+		volumes int
+	}{
+		{10, 25},
+		{100, 3},
+		{250, 1},
+		{1000, 1},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		fileName := filepath.Join(dir, "g_s_d_20261019d.zip")
+		v := &volumeWriter{fileName: fileName, size: tt.size}
+		// writes across borders of volumes
+		for _, chunk := range [][]byte{data[:7], data[7:130], data[130:]} {
+			if _, err := v.Write(chunk); err != nil {
+				t.Fatalf("size %d: Write: %s", tt.size, err)
+			}
+		}
+		if err := v.Close(); err != nil {
+			t.Fatalf("size %d: Close: %s", tt.size, err)
+		}
+		if err := v.writeManifest(); err != nil {
+			t.Fatalf("size %d: writeManifest: %s", tt.size, err)
+		}
+		volumes, sums, err := archiveVolumes(fileName + ".parts")
+		if err != nil {
+			t.Fatalf("size %d: archiveVolumes: %s", tt.size, err)
+		}
+		if len(volumes) != tt.volumes || len(sums) != tt.volumes {
+			t.Errorf("size %d: %d volumes, %d checksums, want %d", tt.size, len(volumes), len(sums), tt.volumes)
+		}
+		for i, volume := range volumes {
+			if want := fmt.Sprintf("%s.%03d", fileName, i+1); volume != want {
+				t.Errorf("size %d: volume %d = %q, want %q", tt.size, i, volume, want)
+			}
+		}
+		r, err := openVolumes(fileName + ".parts")
+		if err != nil {
+			t.Fatalf("size %d: openVolumes: %s", tt.size, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: read %d bytes, %v, not equal to written %d bytes", tt.size, len(got), err, len(data))
+		}
+	}
+}
+
+func TestArchiveVolumesOrder(t *testing.T) {
+	dir := t.TempDir()
+	partsFile := filepath.Join(dir, "a.zip.parts")
+	manifest := "# 3 volumes of 'a.zip'\n" +
+		"# reassemble: cat a.zip.999 a.zip.1000 a.zip.1001 > a.zip\n" +
+		"aaa  a.zip.999\nbbb  a.zip.1000\nccc *a.zip.1001\n"
+	if err := ioutil.WriteFile(partsFile, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	volumes, sums, err := archiveVolumes(partsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a.zip.999", "a.zip.1000", "a.zip.1001"} {
+		if i >= len(volumes) || volumes[i] != filepath.Join(dir, name) {
+			t.Errorf("volumes = %q, want %s at %d", volumes, name, i)
+		}
+	}
+	if sums["a.zip.1001"] != "ccc" {
+		t.Errorf("checksum of 'a.zip.1001' = %q, want %q", sums["a.zip.1001"], "ccc")
+	}
+	r, err := openVolumes(partsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("read of missing volumes: error = nil, want error")
+	}
+}
+
+func TestVolumeWriterRemove(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "g_s_d_20261019d.zip")
+	v := &volumeWriter{fileName: fileName, size: 10}
+	if _, err := v.Write(bytes.Repeat([]byte("x"), 25)); err != nil {
+		t.Fatal(err)
+	}
+	// failed run: no manifest, no volumes
+	v.remove()
+	if files, _ := filepath.Glob(fileName + "*"); len(files) != 0 {
+		t.Errorf("files of failed run = %q, want none", files)
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	// archive is made from snapshot, not from live path of dir
+	srcDir := "/backup/g/s/d/.zfs/snapshot/20261019d"
+	excludes := []string{"*.zfs*", "*.tmp", "/cache", "docs/*/old", "/backup/g/s/d/live"}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{".zfs", true},
+		{"docs/a.tmp", true},
+		{"cache", true},
+		{"docs/cache", false},
+		{"docs/2025/old", true},
+		{"docs/old", false},
+		{"docs/a.txt", false},
+		{"live", false},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(srcDir, tt.rel)
+		if got := isExcluded(srcDir, p, excludes); got != tt.want {
+			t.Errorf("isExcluded(%q, %q) = %t, want %t", srcDir, p, got, tt.want)
+		}
+	}
+}
@@ -1,156 +1,325 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/user"
+	"os/exec"
 	"path"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mistifyio/go-zfs"
 	"github.com/spf13/viper"
 )
 
-var (
-	zSyncUserID int
-)
+// checkFinding - problem found by task 'check'
+type checkFinding struct {
+	Severity string `json:"severity"` // ERROR | WARN | INFO
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix,omitempty"`
+}
 
-func checkcreate() {
-	// check zSyncUser
-	if u, err := user.Lookup(viper.GetString("ZyncUser")); err != nil {
-		log.Panicf("'ZyncUser' not set in config. %s", err)
-	} else {
-		zSyncUserID, err = strconv.Atoi(u.Uid)
+// checkFindings - findings of task 'check'
+type checkFindings []checkFinding
+
+func (f *checkFindings) add(severity, path, message, fix string) {
+	log.Printf("%s: %s: %s\n", severity, path, message)
+	*f = append(*f, checkFinding{Severity: severity, Path: path, Message: message, Fix: fix})
+}
+
+// fix to create missing datasets and dirs
+const checkFixCreate = "run task 'check' with '-checkonly=false'"
+
+// checkcreate checks config, paths and datasets of groups (creates them
+// with '-checkonly=false'), prints findings as table or JSON and returns
+// exit code: 0 - no problems, 1 - warnings, 2 - errors
+func checkcreate() int {
+	var findings checkFindings
+	// check zSyncUser, owner of created dirs
+	zSyncUserID, err := zyncUserID()
+	if err != nil {
+		findings.add("ERROR", "ZyncUser", err.Error(), "set 'ZyncUser' in config to existing user")
+		zSyncUserID = -1
 	}
 	// check logpath
 	if !viper.IsSet("LogPath") {
-		log.Panic("'LogPath' not set in config")
-	}
-	logPath := viper.GetString("LogPath")
-	if _, err := os.Stat(logPath); os.IsNotExist(err) {
-		if checkonly {
-			log.Printf("log dir '%s' not exist\n", logPath)
-		} else {
-			log.Printf("make dir '%s'...\n", logPath)
-			if err := os.MkdirAll(logPath, 0777); err != nil {
-				log.Panic(err)
-			}
-			if err := os.Chown(logPath, zSyncUserID, -1); err != nil {
-				log.Panic(err)
+		findings.add("ERROR", "LogPath", "not set in config", "set 'LogPath' in config")
+	} else {
+		logPath := viper.GetString("LogPath")
+		if _, err := os.Stat(logPath); os.IsNotExist(err) {
+			if checkonly {
+				findings.add("ERROR", logPath, "log dir not exist", checkFixCreate)
+			} else if err := os.MkdirAll(logPath, 0777); err != nil {
+				findings.add("ERROR", logPath, err.Error(), "create dir manually")
+			} else {
+				findings.add("INFO", logPath, "log dir created", "")
+				if err := chownZync(logPath, zSyncUserID); err != nil {
+					findings.add("WARN", logPath, err.Error(), "change owner to 'ZyncUser' manually")
+				}
 			}
 		}
 	}
 	// check zippath
-	zipPath := viper.GetString("ZipPath")
-	if !isExistZfsPartition(zipPath[1:], "") {
-		if !checkonly {
-			makeZfsPartition(zipPath[1:], "")
-		}
+	if !viper.IsSet("ZipPath") {
+		findings.add("ERROR", "ZipPath", "not set in config", "set 'ZipPath' in config")
+	} else {
+		checkZfsPartition(strings.TrimPrefix(viper.GetString("ZipPath"), "/"), "", zSyncUserID, &findings)
 	}
-	// check root backup path
-	if !isExistZfsPartition(viper.GetString("ZfsPath"), "") {
-		log.Panic(fmt.Sprintf("ZFS Volume '%s' not exist", viper.GetString("ZfsPath")))
+	// check scratch path for clones of task 'mount'
+	if viper.IsSet("ScratchPath") {
+		checkZfsPartition(strings.TrimPrefix(viper.GetString("ScratchPath"), "/"), "", zSyncUserID, &findings)
 	}
-
-	// enumerate backups and check path
-	for group := range viper.GetStringMap("groups") {
-		zPath := path.Join(viper.GetString("ZfsPath"), group)
-		if !isExistZfsPartition(zPath, "") {
-			if checkonly {
+	// check root backup path
+	zfsPath := viper.GetString("ZfsPath")
+	if zfsPath == "" {
+		findings.add("ERROR", "ZfsPath", "not set in config", "set 'ZfsPath' in config")
+	} else if exist, err := isExistZfsPartition(zfsPath, ""); !exist {
+		if err == nil {
+			err = fmt.Errorf("ZFS volume not exist")
+		}
+		findings.add("ERROR", zfsPath, err.Error(), fmt.Sprintf("zfs create %s", zfsPath))
+	} else {
+		// enumerate backups and check path
+		for _, group := range sortedKeys(viper.GetStringMap("groups")) {
+			zPath := path.Join(zfsPath, group)
+			if !checkZfsPartition(zPath, "", zSyncUserID, &findings) {
 				continue
-			} else {
-				makeZfsPartition(zPath, "")
 			}
-		}
-		for server := range viper.GetStringMap("groups." + group + ".servers") {
-			zPath := path.Join(zPath, server)
-			if !isExistZfsPartition(zPath, "\t") {
-				if checkonly {
+			keyOfServers := "groups." + group + ".servers"
+			for _, server := range sortedKeys(viper.GetStringMap(keyOfServers)) {
+				zPath := path.Join(zPath, server)
+				if !checkZfsPartition(zPath, "\t", zSyncUserID, &findings) {
 					continue
-				} else {
-					makeZfsPartition(zPath, "\t")
 				}
-			}
-			for dir := range viper.GetStringMap("groups." + group + ".servers." + server + ".dirs") {
-				zPath := path.Join(zPath, dir)
-				if !isExistZfsPartition(zPath, "\t\t") {
-					if checkonly {
+				keyOfDirs := keyOfServers + "." + server + ".dirs"
+				for _, dir := range sortedKeys(viper.GetStringMap(keyOfDirs)) {
+					zPath := path.Join(zPath, dir)
+					if !checkZfsPartition(zPath, "\t\t", zSyncUserID, &findings) || checkonly {
 						continue
-					} else {
-						makeZfsPartition(zPath, "\t\t")
 					}
-				}
-				if !checkonly {
 					//
-					// snapdir option - get/check/set
+					// snapdir option - set
 					//
-					var snapdir string // -o snapdir=visible
-					keyOfSnapdir := "groups." + group + ".servers." + server + ".dirs." + dir + ".snapdir"
-					if viper.IsSet(keyOfSnapdir) {
-						snapdir = viper.GetString(keyOfSnapdir)
-					}
-					switch snapdir {
-					case "visible":
+					snapdir := "hidden" // -o snapdir=visible
+					if viper.GetString(keyOfDirs+"."+dir+".snapdir") == "visible" {
 						snapdir = "visible"
-					default:
-						snapdir = "hidden"
 					}
-					if ds, err := zfs.GetDataset(zPath); err != nil {
-						log.Panic(err)
-					} else {
-						// see next comment
+					ds, err := zfs.GetDataset(zPath)
+					if err == nil {
 						log.Printf("\t\t\tset snapdir = %s", snapdir)
-						if err := ds.SetProperty("snapdir", snapdir); err != nil {
-							log.Panic(err)
-						}
-						// ds.GetProperty("snapdir") - always return "VALUE"
-						/*
-							if current, err := ds.GetProperty("snapdir"); err != nil {
-								log.Panic(err)
-							} else {
-								log.Printf("\t\t\tcurrent snapdir = %s", current)
-								if current != snapdir {
-									log.Printf("\t\t\tset snapdir = %s", snapdir)
-									if err := ds.SetProperty("snapdir", snapdir); err != nil {
-										log.Panic(err)
-									}
-								}
-							}
-						*/
+						err = ds.SetProperty("snapdir", snapdir)
+					}
+					if err != nil {
+						findings.add("ERROR", zPath, err.Error(),
+							fmt.Sprintf("zfs set snapdir=%s %s", snapdir, zPath))
 					}
 				}
-
 			}
 		}
+		checkOrphans(zfsPath, &findings)
 	}
+
+	//
+	// print findings
+	//
+	errNum, warnNum := 0, 0
+	for _, f := range findings {
+		switch f.Severity {
+		case "ERROR":
+			errNum++
+		case "WARN":
+			warnNum++
+		}
+	}
+	if jsonout {
+		if findings == nil {
+			findings = checkFindings{}
+		}
+		out, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			return 2
+		}
+		fmt.Println(string(out))
+	} else {
+		delimeter := strings.Repeat("-", 98)
+		fmt.Printf("%-8s | %-30s | %-30s | %s\n", "Severity", "Path", "Message", "Fix")
+		fmt.Println(delimeter)
+		for _, f := range findings {
+			fmt.Printf("%-8s | %-30s | %-30s | %s\n", f.Severity, f.Path, f.Message, f.Fix)
+		}
+		fmt.Println(delimeter)
+		fmt.Printf("errors/warnings = %d/%d\n", errNum, warnNum)
+	}
+	switch {
+	case errNum > 0:
+		return 2
+	case warnNum > 0:
+		return 1
+	}
+	return 0
 }
 
-func isExistZfsPartition(zPath string, level string) bool {
+// checkZfsPartition checks dataset 'zPath', creates it with '-checkonly=false'.
+// Returns true if dataset exists
+func checkZfsPartition(zPath, level string, uid int, findings *checkFindings) bool {
+	exist, err := isExistZfsPartition(zPath, level)
+	if exist {
+		return true
+	}
+	if err != nil {
+		findings.add("ERROR", zPath, err.Error(), "check ZFS pool and permissions")
+		return false
+	}
+	if checkonly {
+		findings.add("ERROR", zPath, "dataset not exist", checkFixCreate)
+		return false
+	}
+	return makeZfsPartition(zPath, level, uid, findings)
+}
+
+// isExistZfsPartition returns true if dataset 'zPath' exists,
+// error if existence is unknown
+func isExistZfsPartition(zPath string, level string) (bool, error) {
 	msg := fmt.Sprintf("%s%s...", level, zPath)
 	if _, err := zfs.GetDataset(zPath); err != nil {
-		msg += ("ERROR:" + err.Error())
-		if checkonly {
-			log.Println(msg)
-		}
+		log.Printf("%s ERROR: %s\n", msg, strings.TrimSpace(err.Error()))
 		if !strings.Contains(err.Error(), "dataset does not exist") {
-			log.Panicf("%s %s", msg, err)
+			return false, fmt.Errorf("%s", strings.TrimSpace(err.Error()))
 		}
-		return false
+		return false, nil
 	}
 	log.Printf("%s OK\n", msg)
-	return true
+	return true, nil
 }
 
-func makeZfsPartition(zPath string, level string) {
+func makeZfsPartition(zPath string, level string, uid int, findings *checkFindings) bool {
 	ds, err := zfs.CreateFilesystem(zPath, nil)
 	if err != nil {
-		log.Panic(err)
-	} else {
-		log.Printf("%smake new zfs: %s...%s\n", level, ds.Mountpoint, "OK")
-		if err := os.Chown(ds.Mountpoint, zSyncUserID, -1); err != nil {
-			log.Panic(err)
+		findings.add("ERROR", zPath, strings.TrimSpace(err.Error()), fmt.Sprintf("zfs create %s", zPath))
+		return false
+	}
+	log.Printf("%smake new zfs: %s...%s\n", level, ds.Mountpoint, "OK")
+	findings.add("INFO", zPath, "dataset created", "")
+	if err := chownZync(ds.Mountpoint, uid); err != nil {
+		findings.add("WARN", ds.Mountpoint, err.Error(), "change owner to 'ZyncUser' manually")
+	}
+	return true
+}
+
+// chownZync changes owner of 'path' to ZyncUser, if found
+func chownZync(path string, uid int) error {
+	if uid < 0 {
+		return fmt.Errorf("owner not changed, 'ZyncUser' not found")
+	}
+	return os.Chown(path, uid, -1)
+}
+
+// checkOrphans finds datasets under ZfsPath without entries of groups, servers
+// and dirs in config (clones of task 'mount' are ignored) and with '-orphans'
+// reports them, renames into 'OrphanPath' or destroys after confirmation
+func checkOrphans(zfsPath string, findings *checkFindings) {
+	known := map[string]bool{zfsPath: true}
+	for group := range viper.GetStringMap("groups") {
+		known[path.Join(zfsPath, group)] = true
+		keyOfServers := "groups." + group + ".servers"
+		for server := range viper.GetStringMap(keyOfServers) {
+			known[path.Join(zfsPath, group, server)] = true
+			for dir := range viper.GetStringMap(keyOfServers + "." + server + ".dirs") {
+				known[path.Join(zfsPath, group, server, dir)] = true
+			}
+		}
+	}
+	// datasets of zyncnznap under ZfsPath are not orphans
+	var skip []string
+	for _, key := range []string{"ZipPath", "ScratchPath", "OrphanPath"} {
+		if viper.IsSet(key) {
+			skip = append(skip, strings.TrimPrefix(viper.GetString(key), "/"))
+		}
+	}
+	// local replica of task 'replicate'
+	if viper.IsSet("replicate.target") && viper.GetString("replicate.ssh") == "" {
+		skip = append(skip, viper.GetString("replicate.target"))
+	}
+	// depth of dirs: ZfsPath/group/server/dir
+	cmd := exec.Command("zfs", "list", "-H", "-t", "filesystem", "-d", "3",
+		"-o", "name,"+cloneProperty, "-s", "name", zfsPath)
+	outputs, err := cmd.CombinedOutput()
+	if err != nil {
+		findings.add("ERROR", zfsPath, fmt.Sprintf("list datasets: %s, %s",
+			strings.TrimSpace(string(outputs)), err), "check ZFS pool and permissions")
+		return
+	}
+	found := orphanDatasets(string(outputs), known, skip)
+	stdin := bufio.NewReader(os.Stdin)
+	// destroy only with confirmation from terminal, not from pipe or cron
+	terminal := false
+	if fi, err := os.Stdin.Stat(); err == nil {
+		terminal = fi.Mode()&os.ModeCharDevice != 0
+	}
+	for _, zPath := range found {
+		switch orphans {
+		case "rename":
+			if !viper.IsSet("OrphanPath") {
+				findings.add("ERROR", zPath, "orphaned dataset not renamed, 'OrphanPath' not set",
+					"set 'OrphanPath' in config")
+				continue
+			}
+			newPath := path.Join(strings.TrimPrefix(viper.GetString("OrphanPath"), "/"),
+				strings.TrimPrefix(zPath, zfsPath+"/")+"-"+time.Now().Format("20060102"))
+			if outputs, err := exec.Command("zfs", "rename", "-p", zPath, newPath).CombinedOutput(); err != nil {
+				findings.add("ERROR", zPath, fmt.Sprintf("rename orphaned dataset: %s, %s",
+					strings.TrimSpace(string(outputs)), err), fmt.Sprintf("zfs rename -p %s %s", zPath, newPath))
+				continue
+			}
+			findings.add("INFO", zPath, fmt.Sprintf("orphaned dataset renamed to '%s'", newPath), "")
+		case "destroy":
+			if !terminal {
+				findings.add("WARN", zPath, "orphaned dataset, destroy refused, stdin is not a terminal",
+					"run '-orphans=destroy' from terminal, or -orphans=rename")
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Destroy orphaned dataset '%s' with snapshots and children? [y/N] ", zPath)
+			answer, _ := stdin.ReadString('\n')
+			if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+				findings.add("WARN", zPath, "orphaned dataset, destroy not confirmed",
+					"-orphans=destroy and confirm, or -orphans=rename")
+				continue
+			}
+			if outputs, err := exec.Command("zfs", "destroy", "-r", zPath).CombinedOutput(); err != nil {
+				findings.add("ERROR", zPath, fmt.Sprintf("destroy orphaned dataset: %s, %s",
+					strings.TrimSpace(string(outputs)), err), "unmount clones of snapshots (task 'unmount')")
+				continue
+			}
+			findings.add("INFO", zPath, "orphaned dataset destroyed", "")
+		default:
+			findings.add("WARN", zPath, "orphaned dataset, not in config",
+				"-orphans=rename or -orphans=destroy, or add to config")
+		}
+	}
+}
+
+// orphanDatasets returns top-most datasets from output of 'zfs list -o name,<clone property>'
+// not in 'known', not clones and not under 'skip'
+func orphanDatasets(outputs string, known map[string]bool, skip []string) []string {
+	var found []string
+	for _, s := range strings.Split(outputs, "\n") {
+		f := strings.Split(s, "\t")
+		if len(f) != 2 || known[f[0]] || f[1] != "-" {
+			continue
+		}
+		skipped := false
+		for _, p := range append(skip, found...) {
+			// children of orphan are destroyed or renamed with it
+			skipped = skipped || f[0] == p || strings.HasPrefix(f[0], p+"/")
+		}
+		if !skipped {
+			found = append(found, f[0])
 		}
 	}
+	return found
 }
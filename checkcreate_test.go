@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrphanDatasets(t *testing.T) {
+	known := map[string]bool{
+		"pool/backup":       true,
+		"pool/backup/g":     true,
+		"pool/backup/g/s":   true,
+		"pool/backup/g/s/d": true,
+	}
+	skip := []string{"pool/backup/zip", "pool/backup/replica"}
+	tests := []struct {
+		name    string
+		outputs string
+		want    []string
+	}{
+		{"all known", "pool/backup\t-\npool/backup/g\t-\npool/backup/g/s\t-\npool/backup/g/s/d\t-\n", nil},
+		{"orphaned dir", "pool/backup/g/s/d\t-\npool/backup/g/s/old\t-\n", []string{"pool/backup/g/s/old"}},
+		{"children of orphan",
+			"pool/backup/old\t-\npool/backup/old/s\t-\npool/backup/old/s/d\t-\npool/backup/older\t-\n",
+			[]string{"pool/backup/old", "pool/backup/older"}},
+		{"clone of mount", "pool/backup/g/s/d-20261019d\tpool/backup/g/s/d@20261019d\n", nil},
+		{"skipped paths",
+			"pool/backup/zip\t-\npool/backup/zip/x\t-\npool/backup/replica/g\t-\npool/backup/zipold\t-\n",
+			[]string{"pool/backup/zipold"}},
+		{"wrong lines", "\npool/backup/x\n", nil},
+	}
+	for _, tt := range tests {
+		if got := orphanDatasets(tt.outputs, known, skip); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: orphanDatasets() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileCtime returns time of last modification of file, status change is not supported on this OS
+func fileCtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
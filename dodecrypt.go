@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// dodecrypt decrypts archive with 'ArchiveSecretKey' from cfgPath
+// to 'target' (if set) and tests integrity of archive
+func dodecrypt(fileName string) {
+	// temporary decrypted file, removed on exit: os.Exit skips deferred calls
+	tempFile := ""
+	exitWithMsg := func(msg string) {
+		if tempFile != "" {
+			os.Remove(tempFile)
+		}
+		log.Printf("Exit with fatal error: %s\n", msg)
+		os.Exit(1)
+	}
+	format := archiveFileFormat(fileName)
+	if format == "" {
+		exitWithMsg(fmt.Sprintf("Unknown archive format of '%s'", fileName))
+	}
+	plainFile := fileName
+	if strings.HasSuffix(fileName, ".gpg") {
+		if !viper.IsSet("ArchiveSecretKey") {
+			exitWithMsg("'ArchiveSecretKey' not set in config")
+		}
+		plainFile = target
+		if plainFile == "" {
+			// temporary file outside ZipPath, only for test
+			var err error
+			if plainFile, err = tempPlainFile(fileName); err != nil {
+				exitWithMsg(err.Error())
+			}
+			tempFile = plainFile
+			defer os.Remove(tempFile)
+		}
+		if err := decryptArchive(fileName, plainFile,
+			filepath.Join(cfgPath, viper.GetString("ArchiveSecretKey"))); err != nil {
+			os.Remove(plainFile)
+			exitWithMsg(err.Error())
+		}
+		log.Printf("INFO: '%s' decrypted to '%s'", fileName, plainFile)
+	} else if target != "" {
+		exitWithMsg(fmt.Sprintf("'%s' is not encrypted", fileName))
+	}
+	entries, err := verifyArchive(format, plainFile)
+	if err != nil {
+		exitWithMsg(fmt.Sprintf("'%s' is corrupt: %s", fileName, err))
+	}
+	log.Printf("INFO: '%s' = OK, %d entries", fileName, entries)
+}
+
+// decryptArchive decrypts 'fileName' to 'plainFile' with secret key file
+func decryptArchive(fileName, plainFile, secretKey string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return decryptStream(file, plainFile, secretKey)
+}
+
+// decryptStream decrypts encrypted archive from 'in' to 'plainFile' with secret key file
+func decryptStream(in io.Reader, plainFile, secretKey string) error {
+	gpgHome, err := newGpgHome()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gpgHome)
+	if outputs, err := gpgCommand(gpgHome, "--import", secretKey).CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg import: %s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	cmd := gpgCommand(gpgHome, "--output", plainFile, "--decrypt")
+	cmd.Stdin = in
+	if outputs, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg decrypt: %s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	return nil
+}
+
+// tempPlainFile creates empty temporary file in os.TempDir() for decrypted archive
+// 'fileName', not in ZipPath copied to external media
+func tempPlainFile(fileName string) (string, error) {
+	f, err := ioutil.TempFile("", "zyncnznap-*-"+strings.TrimSuffix(filepath.Base(fileName), ".gpg"))
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// archiveFileFormat returns format of archive by extension or ""
+func archiveFileFormat(fileName string) string {
+	name := strings.TrimSuffix(fileName, ".gpg")
+	format := ""
+	for f, ext := range archiveExts {
+		// longest extension: '.tar.gz' before '.gz'
+		if strings.HasSuffix(name, ext) && len(ext) > len(archiveExts[format]) {
+			format = f
+		}
+	}
+	return format
+}
+
+// verifyArchive reads all entries of archive, returns number of entries
+func verifyArchive(format, fileName string) (int, error) {
+	entries := 0
+	if format == "zip" {
+		zr, err := zip.OpenReader(fileName)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				return entries, fmt.Errorf("%s: %s", f.Name, err)
+			}
+			// checksum error at EOF
+			_, err = io.Copy(ioutil.Discard, rc)
+			rc.Close()
+			if err != nil {
+				return entries, fmt.Errorf("%s: %s", f.Name, err)
+			}
+			entries++
+		}
+		return entries, nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return verifyTar(format, file)
+}
+
+// verifyTar reads all entries of tar archive of 'format' from 'file', returns number of entries
+func verifyTar(format string, file io.Reader) (int, error) {
+	entries := 0
+	var r io.Reader
+	var err error
+	var zstd *exec.Cmd
+	var zstdErr bytes.Buffer
+	switch format {
+	case "tar.gz":
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		r = gr
+	case "tar.zst":
+		zstd = exec.Command("zstd", "-q", "-dc")
+		zstd.Stdin = file
+		zstd.Stderr = &zstdErr
+		if r, err = zstd.StdoutPipe(); err != nil {
+			return 0, err
+		}
+		if err := zstd.Start(); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unknown archive format '%s'", format)
+	}
+	tr := tar.NewReader(r)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, tr)
+		}
+		if err != nil {
+			if zstd != nil {
+				zstd.Process.Kill()
+				zstd.Wait()
+			}
+			return entries, err
+		}
+		entries++
+	}
+	if zstd != nil {
+		io.Copy(ioutil.Discard, r)
+		if err := zstd.Wait(); err != nil {
+			return entries, fmt.Errorf("zstd: %s, %s", strings.TrimSpace(zstdErr.String()), err)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/spf13/viper"
+)
+
+type diffTotals struct {
+	warnMsg   string
+	warnNum   int
+	ErrMsg    string
+	ErrNum    int
+	TotalDirs int
+	report    string
+	topDirs   string
+}
+
+// diffSummary - changes between two newest managed snapshots of dir
+type diffSummary struct {
+	from     string
+	to       string
+	added    int
+	modified int
+	removed  int
+	renamed  int
+	dirs     map[string]int // number of changes by top directory
+}
+
+func dodiff(group string) {
+	hostname := getHostName()
+	groupLabel := group
+	if groupLabel == "" {
+		groupLabel = "all"
+	}
+	// check root backup path
+	if _, err := zfs.GetDataset(viper.GetString("ZfsPath")); err != nil {
+		log.Printf("Exit with fatal error: %s\n", err)
+		subj := fmt.Sprintf("zync'n'znap diff %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(groupLabel))
+		if err := sendReport(subj, err.Error()); err != nil {
+			log.Printf("WARN: '%s'", err)
+		}
+		os.Exit(1)
+	}
+	/* end check */
+
+	/*
+		MAIN PROCEDURE
+	*/
+	delimeter := func() string {
+		return "\n" + strings.Repeat("-", 98) + "\n"
+	}
+	totals := diffTotals{
+		report: fmt.Sprintf("%-25s | %14s | %14s | %7s | %8s | %7s | %7s |",
+			"Group/Server/Dir", "From", "To", "Added", "Modified", "Removed", "Renamed"),
+	}
+	totals.report += delimeter()
+	logWarnTotals := func(totals *diffTotals, msg string) {
+		totals.warnNum++
+		totals.warnMsg += msg
+		log.Printf(msg)
+	}
+	for _, group := range snapGroups(group) {
+		if !viper.IsSet("groups." + group) {
+			msg := fmt.Sprintf("WARN: skip group '%s', not found in config\n", group)
+			logWarnTotals(&totals, msg)
+			continue
+		}
+		zPath := path.Join(viper.GetString("ZfsPath"), group)
+		//
+		// enumerate servers
+		//
+		for server := range viper.GetStringMap("groups." + group + ".servers") {
+			zPath := path.Join(zPath, server)
+			//
+			// enumerate dirs
+			//
+			for dir := range viper.GetStringMap("groups." + group + ".servers." + server + ".dirs") {
+				zPath := path.Join(zPath, dir)
+				name := fmt.Sprintf("%s/%s/%s", group, server, dir)
+				totals.TotalDirs++
+				sum, err := snapDiff(zPath)
+				if err != nil {
+					totals.ErrNum++
+					msg := fmt.Sprintf("\tERROR: '%s', error: '%s'\n", name, err.Error())
+					totals.ErrMsg += msg
+					log.Printf(msg)
+					totals.report += fmt.Sprintf("%-25s | %14s | %14s | %7s | %8s | %7s | %7s |\n",
+						name, "ERROR", "ERROR", "-", "-", "-", "-")
+					continue
+				}
+				log.Printf("\tDIFF: '%s' %s..%s = OK\n", name, sum.from, sum.to)
+				totals.report += fmt.Sprintf("%-25s | %14s | %14s | %7d | %8d | %7d | %7d |\n",
+					name, sum.from, sum.to, sum.added, sum.modified, sum.removed, sum.renamed)
+				totals.topDirs += sum.report(name)
+			}
+		}
+	}
+
+	//
+	// make report
+	//
+	subj := fmt.Sprintf("zync'n'znap diff %s/%s: err/warn/total = %d/%d/%d",
+		strings.ToUpper(hostname), strings.ToUpper(groupLabel),
+		totals.ErrNum, totals.warnNum, totals.TotalDirs)
+	msg := totals.report + delimeter() + totals.topDirs + delimeter() +
+		totals.ErrMsg + delimeter() + totals.warnMsg
+	// write report to logpath
+	err := ioutil.WriteFile(
+		filepath.Join(viper.GetString("LogPath"), "diff-report"+snapReportSuffix(group)+".log"),
+		[]byte(subj+"\n\n"+msg), 0666)
+	if err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	// send report
+	if err := sendReport(subj, msg); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+}
+
+// snapDiff runs 'zfs diff' between two newest managed snapshots of dataset
+func snapDiff(zPath string) (diffSummary, error) {
+	sum := diffSummary{dirs: make(map[string]int)}
+	ds, err := zfs.GetDataset(zPath)
+	if err != nil {
+		return sum, err
+	}
+	snaps, err := managedSnapshots(zPath)
+	if err != nil {
+		return sum, err
+	}
+	if len(snaps) < 2 {
+		return sum, fmt.Errorf("less than two snapshots")
+	}
+	from, to := snaps[len(snaps)-2], snaps[len(snaps)-1]
+	sum.from, sum.to = from.snap, to.snap
+	// 'zfs diff from to'
+	changes, err := (&zfs.Dataset{Name: to.name}).Diff(from.name)
+	if err != nil {
+		return sum, err
+	}
+	for _, c := range changes {
+		// skip changes of directories itself
+		if c.Type == zfs.Directory && c.Change == zfs.Modified {
+			continue
+		}
+		switch c.Change {
+		case zfs.Created:
+			sum.added++
+		case zfs.Modified:
+			sum.modified++
+		case zfs.Removed:
+			sum.removed++
+		case zfs.Renamed:
+			sum.renamed++
+		}
+		// top directory relative to mountpoint
+		rel := strings.TrimPrefix(strings.TrimPrefix(c.Path, ds.Mountpoint), "/")
+		top := "/"
+		if i := strings.Index(rel, "/"); i >= 0 {
+			top = rel[:i]
+		}
+		sum.dirs[top]++
+	}
+	return sum, nil
+}
+
+// report returns top directories by number of changes
+func (sum diffSummary) report(name string) string {
+	msg := fmt.Sprintf("%s %s..%s: added/modified/removed/renamed = %d/%d/%d/%d\n",
+		name, sum.from, sum.to, sum.added, sum.modified, sum.removed, sum.renamed)
+	dirs := make([]string, 0, len(sum.dirs))
+	for dir := range sum.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if sum.dirs[dirs[i]] != sum.dirs[dirs[j]] {
+			return sum.dirs[dirs[i]] > sum.dirs[dirs[j]]
+		}
+		return dirs[i] < dirs[j]
+	})
+	topNum := 5
+	if viper.IsSet("DiffTopDirs") {
+		topNum = viper.GetInt("DiffTopDirs")
+	}
+	for i, dir := range dirs {
+		if i >= topNum {
+			break
+		}
+		msg += fmt.Sprintf("\t%8d  %s\n", sum.dirs[dir], dir)
+	}
+	return msg
+}
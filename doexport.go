@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type exportTotals struct {
+	warnMsg   string
+	warnNum   int
+	ErrMsg    string
+	ErrNum    int
+	TotalDirs int
+	report    string
+}
+
+// exportManifest - chain of stream files of dir, JSON file in export path
+type exportManifest struct {
+	Dataset string        `json:"dataset"`
+	Streams []exportEntry `json:"streams"`
+}
+
+type exportEntry struct {
+	File     string    `json:"file"`
+	Snapshot string    `json:"snapshot"`
+	Base     string    `json:"base,omitempty"` // empty for full stream
+	Compress string    `json:"compress"`
+	Created  time.Time `json:"created"`
+	Size     int64     `json:"size"`
+}
+
+func doexport(group string) {
+	hostname := getHostName()
+	groupLabel := group
+	if groupLabel == "" {
+		groupLabel = "all"
+	}
+	/*
+		RUN CHECK'S
+	*/
+	exitWithMailMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		subj := fmt.Sprintf("zync'n'znap export %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(groupLabel))
+		if err := sendReport(subj, msg); err != nil {
+			log.Printf("WARN: '%s'", err)
+		}
+		os.Exit(1)
+	}
+	exportPath := viper.GetString("export.path")
+	if _, err := os.Stat(exportPath); exportPath == "" || os.IsNotExist(err) {
+		exitWithMailMsg(fmt.Sprintf("Export path '%s' not set or not exist", exportPath))
+	}
+	if _, err := exportKeyFile(); err != nil {
+		exitWithMailMsg(err.Error())
+	}
+	compress := exportCompress()
+	if _, ok := compressCommands[compress]; !ok {
+		exitWithMailMsg(fmt.Sprintf("'export.compress' = '%s', must be gzip | zstd | none", compress))
+	}
+	/* end common check's */
+
+	/*
+		MAIN PROCEDURE
+	*/
+	delimeter := func() string {
+		return "\n" + strings.Repeat("-", 98) + "\n"
+	}
+	totals := exportTotals{
+		report: fmt.Sprintf("%-25s | %6s | %16s | %16s | %11s | %7s |",
+			"Group/Server/Dir", "Mode", "Base", "Snapshot", "Size Mb", "Minutes"),
+	}
+	totals.report += delimeter()
+	logWarnTotals := func(totals *exportTotals, msg string) {
+		totals.warnNum++
+		totals.warnMsg += msg
+		log.Printf(msg)
+	}
+	for _, group := range snapGroups(group) {
+		if !viper.IsSet("groups." + group) {
+			msg := fmt.Sprintf("WARN: skip group '%s', not found in config\n", group)
+			logWarnTotals(&totals, msg)
+			continue
+		}
+		for _, server := range sortedKeys(viper.GetStringMap("groups." + group + ".servers")) {
+			keyOfDirs := "groups." + group + ".servers." + server + ".dirs"
+			for _, dir := range sortedKeys(viper.GetStringMap(keyOfDirs)) {
+				// only dirs with 'export = true'
+				if !viper.GetBool(keyOfDirs + "." + dir + ".export") {
+					continue
+				}
+				name := fmt.Sprintf("%s/%s/%s", group, server, dir)
+				totals.TotalDirs++
+				timeStart := time.Now()
+				entry, err := exportDataset(exportPath, group, server, dir, compress)
+				mode := "incr"
+				if entry.Base == "" {
+					mode = "full"
+				}
+				if err != nil {
+					totals.ErrNum++
+					msg := fmt.Sprintf("\tERROR: '%s', error: '%s'\n", name, err.Error())
+					totals.ErrMsg += msg
+					log.Printf(msg)
+					mode = "ERROR"
+				} else if entry.File == "" {
+					mode = "skip"
+					log.Printf("\tEXPORT: '%s' %s already exported\n", name, entry.Snapshot)
+				} else {
+					log.Printf("\tEXPORT: '%s' %s = OK\n", name, entry.File)
+				}
+				totals.report += fmt.Sprintf("%-25s | %6s | %16s | %16s | %11s | %7.2f |\n",
+					name, mode, entry.Base, entry.Snapshot, sizeMb(uint64(entry.Size)),
+					time.Since(timeStart).Minutes())
+			}
+		}
+	}
+
+	//
+	// make report
+	//
+	subj := fmt.Sprintf("zync'n'znap export %s/%s: err/warn/total = %d/%d/%d",
+		strings.ToUpper(hostname), strings.ToUpper(groupLabel),
+		totals.ErrNum, totals.warnNum, totals.TotalDirs)
+	msg := fmt.Sprintf("Export path: %s\n", exportPath) + delimeter() +
+		totals.report + delimeter() + totals.ErrMsg + delimeter() + totals.warnMsg
+	// write report to logpath
+	err := ioutil.WriteFile(
+		filepath.Join(viper.GetString("LogPath"), "export-report"+snapReportSuffix(group)+".log"),
+		[]byte(subj+"\n\n"+msg), 0666)
+	if err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	// send report
+	if err := sendReport(subj, msg); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+}
+
+// exportDataset writes stream of newest managed snapshot of dir to file:
+// incremental from last exported snapshot or full
+func exportDataset(exportPath, group, server, dir, compress string) (exportEntry, error) {
+	zPath := path.Join(viper.GetString("ZfsPath"), group, server, dir)
+	prefix := strings.Join([]string{group, server, dir}, "_")
+	manifestFile := filepath.Join(exportPath, prefix+".manifest.json")
+	manifest, err := readManifest(manifestFile)
+	if err != nil {
+		return exportEntry{}, err
+	}
+	manifest.Dataset = zPath
+	snaps, err := managedSnapshots(zPath)
+	if err != nil {
+		return exportEntry{}, err
+	}
+	if len(snaps) == 0 {
+		return exportEntry{}, fmt.Errorf("no snapshots")
+	}
+	newest := snaps[len(snaps)-1]
+	entry := exportEntry{
+		Snapshot: newest.snap,
+		Compress: compress,
+		Created:  time.Now(),
+	}
+	// base - last exported snapshot, if it still exists
+	if n := len(manifest.Streams); n > 0 && !fullexport {
+		last := manifest.Streams[n-1].Snapshot
+		if last == newest.snap {
+			return exportEntry{Snapshot: last, Base: manifest.Streams[n-1].Base}, nil
+		}
+		for _, sn := range snaps {
+			if sn.snap == last {
+				entry.Base = last
+			}
+		}
+		if entry.Base == "" {
+			log.Printf("\tWARN: '%s@%s' not exist, full export", zPath, last)
+		}
+	}
+	sendArgs := []string{"send", newest.name}
+	entry.File = prefix + "_" + newest.snap
+	if entry.Base != "" {
+		sendArgs = []string{"send", "-i", zPath + "@" + entry.Base, newest.name}
+		entry.File += "_from_" + entry.Base
+	}
+	entry.File += ".zfs" + compressCommands[compress].ext + ".gpg"
+	keyFile, _ := exportKeyFile()
+	cmds := []*exec.Cmd{exec.Command("zfs", sendArgs...)}
+	if c := compressCommands[compress].compress; c != nil {
+		cmds = append(cmds, exec.Command(c[0], c[1:]...))
+	}
+	cmds = append(cmds, exec.Command("gpg", "--batch", "--yes", "--pinentry-mode", "loopback",
+		"--symmetric", "--cipher-algo", "AES256", "--compress-algo", "none",
+		"--passphrase-file", keyFile))
+	// write to temporary file, rename after success
+	tmpFile := filepath.Join(exportPath, "."+entry.File+".part")
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return entry, err
+	}
+	err = runPipeline(out, cmds...)
+	out.Close()
+	if err != nil {
+		os.Remove(tmpFile)
+		return entry, err
+	}
+	if err := os.Rename(tmpFile, filepath.Join(exportPath, entry.File)); err != nil {
+		return entry, err
+	}
+	if fstat, err := os.Stat(filepath.Join(exportPath, entry.File)); err == nil {
+		entry.Size = fstat.Size()
+	}
+	manifest.Streams = append(manifest.Streams, entry)
+	return entry, writeManifest(manifestFile, manifest)
+}
+
+func doimport(group, server, dir string) {
+	name := strings.Join([]string{group, server, dir}, "/")
+	exitWithMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		os.Exit(1)
+	}
+	exportPath := viper.GetString("export.path")
+	keyFile, err := exportKeyFile()
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	manifestFile := filepath.Join(exportPath, strings.Join([]string{group, server, dir}, "_")+".manifest.json")
+	manifest, err := readManifest(manifestFile)
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	if len(manifest.Streams) == 0 {
+		exitWithMsg(fmt.Sprintf("No streams of '%s' in '%s'", name, manifestFile))
+	}
+	// chain from the last full stream
+	start := 0
+	for i, entry := range manifest.Streams {
+		if entry.Base == "" {
+			start = i
+		}
+	}
+	existing := make(map[string]bool)
+	if outputs, err := exec.Command("zfs", "list", "-H", "-t", "snapshot", "-d", "1",
+		"-o", "name", target).CombinedOutput(); err == nil {
+		for _, s := range strings.Split(string(outputs), "\n") {
+			if i := strings.Index(s, "@"); i >= 0 {
+				existing[strings.TrimSpace(s[i+1:])] = true
+			}
+		}
+	}
+	for _, entry := range manifest.Streams[start:] {
+		if existing[entry.Snapshot] {
+			log.Printf("\tIMPORT: '%s@%s' exist, skip", target, entry.Snapshot)
+			continue
+		}
+		if entry.Base != "" && !existing[entry.Base] {
+			exitWithMsg(fmt.Sprintf("Base '%s@%s' of '%s' not exist", target, entry.Base, entry.File))
+		}
+		c, ok := compressCommands[entry.Compress]
+		if !ok {
+			exitWithMsg(fmt.Sprintf("Unknown compress '%s' of '%s'", entry.Compress, entry.File))
+		}
+		cmds := []*exec.Cmd{exec.Command("gpg", "--batch", "--pinentry-mode", "loopback",
+			"--passphrase-file", keyFile, "--decrypt", filepath.Join(exportPath, entry.File))}
+		if c.decompress != nil {
+			cmds = append(cmds, exec.Command(c.decompress[0], c.decompress[1:]...))
+		}
+		cmds = append(cmds, exec.Command("zfs", "receive", "-u", "-F", target))
+		if dryrun {
+			log.Printf("\tIMPORT: '%s' to '%s' (dry-run)", entry.File, target)
+			existing[entry.Snapshot] = true
+			continue
+		}
+		if err := runPipeline(ioutil.Discard, cmds...); err != nil {
+			exitWithMsg(fmt.Sprintf("'%s': %s", entry.File, err))
+		}
+		existing[entry.Snapshot] = true
+		log.Printf("\tIMPORT: '%s' to '%s' = OK", entry.File, target)
+	}
+}
+
+// compress/decompress commands of export streams
+var compressCommands = map[string]struct {
+	ext        string
+	compress   []string
+	decompress []string
+}{
+	"none": {"", nil, nil},
+	"gzip": {".gz", []string{"gzip", "-c"}, []string{"gzip", "-dc"}},
+	"zstd": {".zst", []string{"zstd", "-q", "-c"}, []string{"zstd", "-q", "-dc"}},
+}
+
+// exportCompress returns 'export.compress', default gzip
+func exportCompress() string {
+	if viper.IsSet("export.compress") {
+		return viper.GetString("export.compress")
+	}
+	return "gzip"
+}
+
+// exportKeyFile returns passphrase file 'export.keyfile' from cfgPath
+func exportKeyFile() (string, error) {
+	if !viper.IsSet("export.keyfile") {
+		return "", fmt.Errorf("'export.keyfile' not set in config")
+	}
+	keyFile := filepath.Join(cfgPath, viper.GetString("export.keyfile"))
+	if _, err := os.Stat(keyFile); err != nil {
+		return "", err
+	}
+	return keyFile, nil
+}
+
+func readManifest(manifestFile string) (exportManifest, error) {
+	var manifest exportManifest
+	data, err := ioutil.ReadFile(manifestFile)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+func writeManifest(manifestFile string, manifest exportManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestFile, data, 0644)
+}
+
+// runPipeline runs 'cmds[0] | cmds[1] | ... > output'
+func runPipeline(output io.Writer, cmds ...*exec.Cmd) error {
+	var pipes []*os.File
+	stderr := make([]bytes.Buffer, len(cmds))
+	for i := range cmds {
+		cmds[i].Stderr = &stderr[i]
+		if i < len(cmds)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return err
+			}
+			cmds[i].Stdout = w
+			cmds[i+1].Stdin = r
+			pipes = append(pipes, r, w)
+		}
+	}
+	cmds[len(cmds)-1].Stdout = output
+	started := 0
+	var err error
+	for _, cmd := range cmds {
+		if err = cmd.Start(); err != nil {
+			break
+		}
+		started++
+	}
+	// pipes used by child processes only
+	for _, p := range pipes {
+		p.Close()
+	}
+	if err != nil {
+		for _, cmd := range cmds[:started] {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		return err
+	}
+	for i, cmd := range cmds {
+		if waitErr := cmd.Wait(); waitErr != nil && err == nil {
+			err = fmt.Errorf("%s: %s, %s", cmd.Args[0], strings.TrimSpace(stderr[i].String()), waitErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// listDir - dir dataset with managed snapshots, JSON output of task 'list'
+type listDir struct {
+	Group     string     `json:"group"`
+	Server    string     `json:"server"`
+	Dir       string     `json:"dir"`
+	Dataset   string     `json:"dataset"`
+	Error     string     `json:"error,omitempty"`
+	Snapshots []listSnap `json:"snapshots"`
+}
+
+type listSnap struct {
+	Name       string    `json:"name"`
+	Label      string    `json:"label"`
+	Creation   time.Time `json:"creation"`
+	Used       uint64    `json:"used"`
+	Referenced uint64    `json:"referenced"`
+}
+
+func dolist(group string) {
+	var dirs []listDir
+	for _, group := range snapGroups(group) {
+		if !viper.IsSet("groups." + group) {
+			log.Printf("WARN: skip group '%s', not found in config\n", group)
+			continue
+		}
+		servers := sortedKeys(viper.GetStringMap("groups." + group + ".servers"))
+		for _, server := range servers {
+			keyOfDirs := "groups." + group + ".servers." + server + ".dirs"
+			for _, dir := range sortedKeys(viper.GetStringMap(keyOfDirs)) {
+				ld := listDir{
+					Group:     group,
+					Server:    server,
+					Dir:       dir,
+					Dataset:   path.Join(viper.GetString("ZfsPath"), group, server, dir),
+					Snapshots: []listSnap{},
+				}
+				snaps, err := managedSnapshots(ld.Dataset)
+				if err != nil {
+					ld.Error = err.Error()
+					log.Printf("WARN: '%s': %s", ld.Dataset, err)
+				}
+				for _, sn := range snaps {
+					ld.Snapshots = append(ld.Snapshots, listSnap{
+						Name:       sn.snap,
+						Label:      sn.label,
+						Creation:   sn.creation,
+						Used:       sn.used,
+						Referenced: sn.referenced,
+					})
+				}
+				dirs = append(dirs, ld)
+			}
+		}
+	}
+
+	if jsonout {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(dirs); err != nil {
+			log.Printf("ERROR: '%s'", err)
+			os.Exit(1)
+		}
+		return
+	}
+	for _, ld := range dirs {
+		fmt.Printf("%s/%s/%s (%s)\n", ld.Group, ld.Server, ld.Dir, ld.Dataset)
+		if ld.Error != "" {
+			fmt.Printf("\tERROR: %s\n\n", ld.Error)
+			continue
+		}
+		fmt.Printf("\t%-16s | %5s | %16s | %11s | %11s |\n",
+			"Snapshot", "Label", "Creation", "Used Mb", "Refer Mb")
+		for _, sn := range ld.Snapshots {
+			fmt.Printf("\t%-16s | %5s | %16s | %11s | %11s |\n",
+				sn.Name, sn.Label, sn.Creation.Format("2006-01-02 15:04"),
+				sizeMb(sn.Used), sizeMb(sn.Referenced))
+		}
+		fmt.Println("")
+	}
+}
+
+// sortedKeys returns sorted keys of config map
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
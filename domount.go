@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/spf13/viper"
+)
+
+// user property of clones made by task 'mount'
+const cloneProperty = "zyncnznap:origin"
+
+func domount(group, server, dir string) {
+	name := strings.Join([]string{group, server, dir}, "/")
+	exitWithMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		os.Exit(1)
+	}
+	scratch, err := scratchDataset()
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	zPath := path.Join(viper.GetString("ZfsPath"), group, server, dir)
+	snaps, err := managedSnapshots(zPath)
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	snap, err := resolveSnapshot(snaps, snapshot)
+	if err != nil {
+		exitWithMsg(fmt.Sprintf("Snapshot '%s' of '%s': %s", snapshot, name, err))
+	}
+	uid, err := zyncUserID()
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	cloneName := path.Join(scratch.Name, strings.Join([]string{group, server, dir, snap.snap}, "-"))
+	if _, err := zfs.GetDataset(cloneName); err == nil {
+		exitWithMsg(fmt.Sprintf("Clone '%s' already exist", cloneName))
+	}
+	// Clone needs dataset of type snapshot
+	snapDs, err := zfs.GetDataset(snap.name)
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	clone, err := snapDs.Clone(cloneName, map[string]string{
+		cloneProperty: snap.name,
+		"snapdir":     "hidden",
+	})
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	if err := os.Chown(clone.Mountpoint, uid, -1); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	log.Printf("INFO: '%s' mounted as '%s' at '%s'", snap.name, clone.Name, clone.Mountpoint)
+}
+
+func dounmount(group, server, dir string) {
+	exitWithMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		os.Exit(1)
+	}
+	scratch, err := scratchDataset()
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	zPath := path.Join(viper.GetString("ZfsPath"), group, server, dir)
+	clones, err := zyncClones(scratch.Name)
+	if err != nil {
+		exitWithMsg(err.Error())
+	}
+	// all clones of dir for default '-snapshot=latest'
+	destroyed := 0
+	for cloneName, origin := range clones {
+		if !strings.HasPrefix(origin, zPath+"@") {
+			continue
+		}
+		if snapshot != "" && snapshot != "latest" && origin != zPath+"@"+snapshot {
+			continue
+		}
+		if err := (&zfs.Dataset{Name: cloneName}).Destroy(zfs.DestroyForceUmount); err != nil {
+			exitWithMsg(err.Error())
+		}
+		destroyed++
+		log.Printf("INFO: clone '%s' of '%s' destroyed", cloneName, origin)
+	}
+	if destroyed == 0 {
+		exitWithMsg(fmt.Sprintf("Clones of '%s' not found in '%s'", zPath, scratch.Name))
+	}
+}
+
+// scratchDataset returns dataset of 'ScratchPath' for clones
+func scratchDataset() (*zfs.Dataset, error) {
+	if !viper.IsSet("ScratchPath") {
+		return nil, fmt.Errorf("'ScratchPath' not set in config")
+	}
+	return zfs.GetDataset(strings.TrimPrefix(viper.GetString("ScratchPath"), "/"))
+}
+
+// zyncClones returns clones made by task 'mount': clone name => origin snapshot
+func zyncClones(scratch string) (map[string]string, error) {
+	clones := make(map[string]string)
+	datasets, err := zfs.Filesystems(scratch)
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range datasets {
+		props, err := zfsGetProps(ds.Name, cloneProperty)
+		if err != nil {
+			return nil, err
+		}
+		if origin := props[cloneProperty]; origin != "" && origin != "-" {
+			clones[ds.Name] = origin
+		}
+	}
+	return clones, nil
+}
+
+// zyncUserID returns uid of 'ZyncUser'
+func zyncUserID() (int, error) {
+	u, err := user.Lookup(viper.GetString("ZyncUser"))
+	if err != nil {
+		return 0, fmt.Errorf("'ZyncUser' not set in config. %s", err)
+	}
+	return strconv.Atoi(u.Uid)
+}
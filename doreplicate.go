@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type replicateTotals struct {
+	warnMsg   string
+	warnNum   int
+	ErrMsg    string
+	ErrNum    int
+	TotalDirs int
+	report    string
+}
+
+// countReader counts bytes of zfs send stream
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func doreplicate(group string) {
+	hostname := getHostName()
+	groupLabel := group
+	if groupLabel == "" {
+		groupLabel = "all"
+	}
+	lockFileName := filepath.Join(
+		"/var/tmp", strings.Split(filepath.Base(os.Args[0]), ".")[0]+"-replicate.lock")
+	// lock file is removed only by process which created it
+	locked := false
+	/*
+		RUN CHECK'S
+	*/
+	exitWithMailMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		subj := fmt.Sprintf("zync'n'znap replicate %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(groupLabel))
+		if err := sendReport(subj, msg); err != nil {
+			log.Printf("WARN: '%s'", err)
+		}
+		if locked {
+			os.Remove(lockFileName)
+		}
+		os.Exit(1)
+	}
+	// check one: it's already running?
+	if _, err := os.Stat(lockFileName); err == nil {
+		if procnum, err := ioutil.ReadFile(lockFileName); err != nil {
+			exitWithMailMsg("read lock file: " + err.Error())
+		} else {
+			exitWithMailMsg(fmt.Sprintf("File '%s' is exist, process number: %s",
+				lockFileName, string(procnum)))
+		}
+	}
+	// - create pid, fails if other process created it after check
+	lockFile, err := os.OpenFile(lockFileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		exitWithMailMsg("write pid file: " + err.Error())
+	}
+	locked = true
+	_, err = lockFile.WriteString(strconv.Itoa(os.Getpid()))
+	if cerr := lockFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		exitWithMailMsg("write pid file: " + err.Error())
+	}
+	// check target dataset
+	if !viper.IsSet("replicate.target") {
+		exitWithMailMsg("'replicate.target' not set in config")
+	}
+	targetRoot := viper.GetString("replicate.target")
+	if outputs, err := replicaCommand("zfs", "list", "-H", "-o", "name", targetRoot).CombinedOutput(); err != nil {
+		exitWithMailMsg(fmt.Sprintf("Target '%s': %s, %s", targetRoot, strings.TrimSpace(string(outputs)), err))
+	}
+	/* end common check's */
+
+	/*
+		MAIN PROCEDURE
+	*/
+	delimeter := func() string {
+		return "\n" + strings.Repeat("-", 86) + "\n"
+	}
+	totals := replicateTotals{
+		report: fmt.Sprintf("%-25s | %8s | %16s | %11s | %7s |",
+			"Group/Server/Dir", "Mode", "Last snapshot", "Sent Mb", "Minutes"),
+	}
+	totals.report += delimeter()
+	logWarnTotals := func(totals *replicateTotals, msg string) {
+		totals.warnNum++
+		totals.warnMsg += msg
+		log.Printf(msg)
+	}
+	for _, group := range snapGroups(group) {
+		if !viper.IsSet("groups." + group) {
+			msg := fmt.Sprintf("WARN: skip group '%s', not found in config\n", group)
+			logWarnTotals(&totals, msg)
+			continue
+		}
+		//
+		// enumerate servers
+		//
+		for _, server := range sortedKeys(viper.GetStringMap("groups." + group + ".servers")) {
+			//
+			// enumerate dirs
+			//
+			keyOfDirs := "groups." + group + ".servers." + server + ".dirs"
+			for _, dir := range sortedKeys(viper.GetStringMap(keyOfDirs)) {
+				name := fmt.Sprintf("%s/%s/%s", group, server, dir)
+				zPath := path.Join(viper.GetString("ZfsPath"), group, server, dir)
+				tPath := path.Join(targetRoot, group, server, dir)
+				totals.TotalDirs++
+				timeStart := time.Now()
+				mode, last, sent, err := replicateDataset(zPath, tPath)
+				if err != nil {
+					totals.ErrNum++
+					msg := fmt.Sprintf("\tERROR: '%s', error: '%s'\n", name, err.Error())
+					totals.ErrMsg += msg
+					log.Printf(msg)
+					if mode != "partial" {
+						mode = "ERROR"
+					}
+				} else {
+					log.Printf("\tREPLICATE: '%s' %s %s = OK\n", name, mode, last)
+				}
+				totals.report += fmt.Sprintf("%-25s | %8s | %16s | %11s | %7.2f |\n",
+					name, mode, last, sizeMb(uint64(sent)), time.Since(timeStart).Minutes())
+			}
+		}
+	}
+
+	//
+	// make report
+	//
+	subj := fmt.Sprintf("zync'n'znap replicate %s/%s: err/warn/total = %d/%d/%d",
+		strings.ToUpper(hostname), strings.ToUpper(groupLabel),
+		totals.ErrNum, totals.warnNum, totals.TotalDirs)
+	msg := fmt.Sprintf("Target: %s %s\n", viper.GetString("replicate.ssh"), targetRoot) +
+		delimeter() + totals.report + delimeter() + totals.ErrMsg + delimeter() + totals.warnMsg
+	// write report to logpath
+	err = ioutil.WriteFile(
+		filepath.Join(viper.GetString("LogPath"), "replicate-report"+snapReportSuffix(group)+".log"),
+		[]byte(subj+"\n\n"+msg), 0666)
+	if err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	// send report
+	if err := sendReport(subj, msg); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	os.Remove(lockFileName)
+}
+
+// replicateDataset sends managed snapshots of 'zPath' to 'tPath':
+// resume of interrupted receive, full send of the oldest snapshot
+// for new target, then incremental
+func replicateDataset(zPath, tPath string) (mode, last string, sent int64, err error) {
+	snaps, err := managedSnapshots(zPath)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if len(snaps) == 0 {
+		return "", "", 0, fmt.Errorf("no snapshots")
+	}
+	newest := snaps[len(snaps)-1]
+	// 'zfs send <sendArgs> | zfs receive -s', interrupted receive can be resumed
+	sendRecv := func(recvArgs []string, sendArgs ...string) error {
+		total := sendSize(sendArgs...)
+		recvArgs = append([]string{"receive", "-s", "-u"}, append(recvArgs, tPath)...)
+		n, err := runPipe(exec.Command("zfs", append([]string{"send"}, sendArgs...)...),
+			replicaCommand("zfs", recvArgs...))
+		sent += n
+		if err != nil {
+			if token := replicaResumeToken(tPath); token != "" {
+				mode = "partial"
+				return fmt.Errorf("sent %s of %s Mb, resumable: %s", sizeMb(uint64(n)), sizeMb(total), err)
+			}
+			return err
+		}
+		return nil
+	}
+	// resume interrupted receive
+	if token := replicaResumeToken(tPath); token != "" {
+		mode = "resume"
+		log.Printf("\tINFO: resume receive of '%s'", tPath)
+		if err := sendRecv(nil, "-t", token); err != nil {
+			return mode, "", sent, err
+		}
+	}
+	replicaSnaps, exist, err := replicaSnapshots(tPath)
+	if err != nil {
+		return mode, "", sent, err
+	}
+	if !exist {
+		// first full send
+		mode = "full"
+		if outputs, err := replicaCommand("zfs", "create", "-p", path.Dir(tPath)).CombinedOutput(); err != nil {
+			return mode, "", 0, fmt.Errorf("%s, %s", strings.TrimSpace(string(outputs)), err)
+		}
+		if err := sendRecv(nil, snaps[0].name); err != nil {
+			return mode, "", sent, err
+		}
+		// single snapshot falls through to bookmark
+		replicaSnaps = map[string]bool{snaps[0].snap: true}
+	} else if mode == "" {
+		mode = "incr"
+	}
+	// newest common snapshot
+	base := -1
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if replicaSnaps[snaps[i].snap] {
+			base = i
+			break
+		}
+	}
+	if base < 0 {
+		// base snapshot pruned by task 'snap' - send from bookmark
+		bookmark, next, err := replicaBookmark(zPath, snaps, replicaSnaps)
+		if err != nil {
+			return mode, "", sent, fmt.Errorf("no common snapshot with '%s': %s", tPath, err)
+		}
+		log.Printf("\tINFO: send '%s' from bookmark '%s'", snaps[next].name, bookmark)
+		if err := sendRecv([]string{"-F"}, "-i", bookmark, snaps[next].name); err != nil {
+			return mode, "", sent, err
+		}
+		base = next
+	}
+	if base < len(snaps)-1 {
+		if err := sendRecv([]string{"-F"}, "-I", snaps[base].name, newest.name); err != nil {
+			return mode, snaps[base].snap, sent, err
+		}
+	} else if mode == "incr" {
+		mode = "uptodate"
+	}
+	if err := markReplicated(zPath, newest.snap); err != nil {
+		log.Printf("\tWARN: bookmark of '%s': %s", newest.name, err)
+	}
+	return mode, newest.snap, sent, nil
+}
+
+// user property of dir dataset: last replicated snapshot
+const replicatedProperty = "zyncnznap:replicated"
+
+// markReplicated creates bookmark 'zPath#snap' of last replicated snapshot,
+// saves it in 'zyncnznap:replicated' and destroys older bookmarks
+func markReplicated(zPath, snap string) error {
+	if !zfsExist(zPath + "#" + snap) {
+		if outputs, err := exec.Command("zfs", "bookmark", zPath+"@"+snap,
+			zPath+"#"+snap).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s, %s", strings.TrimSpace(string(outputs)), err)
+		}
+	}
+	if outputs, err := exec.Command("zfs", "set", replicatedProperty+"="+snap,
+		zPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	outputs, err := exec.Command("zfs", "list", "-H", "-t", "bookmark", "-d", "1",
+		"-o", "name", zPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	for _, s := range strings.Split(string(outputs), "\n") {
+		i := strings.Index(s, "#")
+		if i < 0 || s[i+1:] == snap || !managedSnapRe.MatchString(s[i+1:]) {
+			continue
+		}
+		if outputs, err := exec.Command("zfs", "destroy", s).CombinedOutput(); err != nil {
+			log.Printf("\tWARN: destroy '%s': %s, %s", s, strings.TrimSpace(string(outputs)), err)
+		}
+	}
+	return nil
+}
+
+// replicaBookmark returns bookmark of last replicated snapshot
+// and index of the first snapshot after it
+func replicaBookmark(zPath string, snaps []managedSnap, replicaSnaps map[string]bool) (string, int, error) {
+	props, err := zfsGetProps(zPath, replicatedProperty)
+	if err != nil {
+		return "", 0, err
+	}
+	replicated := props[replicatedProperty]
+	if replicated == "" || replicated == "-" || !replicaSnaps[replicated] {
+		return "", 0, fmt.Errorf("no replicated bookmark")
+	}
+	bookmark := zPath + "#" + replicated
+	props, err = zfsGetProps(bookmark, "creation")
+	if err != nil {
+		return "", 0, err
+	}
+	created := time.Unix(int64(propUint(props, "creation")), 0)
+	for i, sn := range snaps {
+		if sn.creation.After(created) {
+			return bookmark, i, nil
+		}
+	}
+	return "", 0, fmt.Errorf("no snapshots after '%s'", bookmark)
+}
+
+// zfsExist returns true if dataset, snapshot or bookmark exist
+func zfsExist(name string) bool {
+	_, err := zfsGetProps(name, "name")
+	return err == nil
+}
+
+// replicaResumeToken returns 'receive_resume_token' of target dataset or ""
+func replicaResumeToken(tPath string) string {
+	outputs, err := replicaCommand("zfs", "get", "-H", "-o", "value",
+		"receive_resume_token", tPath).Output()
+	if err != nil {
+		return ""
+	}
+	token := strings.TrimSpace(string(outputs))
+	if token == "-" {
+		return ""
+	}
+	return token
+}
+
+// sendSize returns estimated size of 'zfs send' stream or 0
+func sendSize(sendArgs ...string) uint64 {
+	outputs, err := exec.Command("zfs", append([]string{"send", "-nP"}, sendArgs...)...).CombinedOutput()
+	if err != nil {
+		return 0
+	}
+	for _, s := range strings.Split(string(outputs), "\n") {
+		if f := strings.Fields(s); len(f) == 2 && f[0] == "size" {
+			size, _ := strconv.ParseUint(f[1], 10, 64)
+			return size
+		}
+	}
+	return 0
+}
+
+// replicaSnapshots returns names (after '@') of snapshots of target dataset
+func replicaSnapshots(tPath string) (map[string]bool, bool, error) {
+	snaps := make(map[string]bool)
+	outputs, err := replicaCommand("zfs", "list", "-Hp", "-t", "snapshot", "-d", "1",
+		"-o", "name", tPath).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(outputs), "dataset does not exist") {
+			return snaps, false, nil
+		}
+		return nil, false, fmt.Errorf("%s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	for _, s := range strings.Split(string(outputs), "\n") {
+		if i := strings.Index(s, "@"); i >= 0 {
+			snaps[strings.TrimSpace(s[i+1:])] = true
+		}
+	}
+	return snaps, true, nil
+}
+
+// replicaCommand returns command for target side,
+// via 'replicate.ssh' (like 'ssh -p 22 root@backup2') if set
+func replicaCommand(name string, arg ...string) *exec.Cmd {
+	ssh := strings.Fields(viper.GetString("replicate.ssh"))
+	if len(ssh) == 0 {
+		return exec.Command(name, arg...)
+	}
+	// remote shell parses command line, paths of files may contain any chars
+	words := []string{shellQuote(name)}
+	for _, a := range arg {
+		words = append(words, shellQuote(a))
+	}
+	return exec.Command(ssh[0], append(ssh[1:], strings.Join(words, " "))...)
+}
+
+// shellQuote returns 's' in single quotes for remote shell, a quote inside is closed, escaped and reopened
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runPipe runs 'send | recv', returns size of stream
+func runPipe(send, recv *exec.Cmd) (int64, error) {
+	var sendErr, recvErr bytes.Buffer
+	send.Stderr = &sendErr
+	recv.Stderr = &recvErr
+	stream, err := send.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	counter := &countReader{r: stream}
+	recv.Stdin = counter
+	if err := send.Start(); err != nil {
+		return 0, err
+	}
+	if err := recv.Start(); err != nil {
+		stream.Close()
+		send.Wait()
+		return 0, err
+	}
+	recvWaitErr := recv.Wait()
+	// unblock 'send' if 'recv' exit with error
+	stream.Close()
+	sendWaitErr := send.Wait()
+	if sendWaitErr != nil {
+		return counter.n, fmt.Errorf("send: %s, %s", strings.TrimSpace(sendErr.String()), sendWaitErr)
+	}
+	if recvWaitErr != nil {
+		return counter.n, fmt.Errorf("receive: %s, %s", strings.TrimSpace(recvErr.String()), recvWaitErr)
+	}
+	return counter.n, nil
+}
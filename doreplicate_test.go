@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"", `''`},
+		{"zfs", `'zfs'`},
+		{"pool/backup/g s/d", `'pool/backup/g s/d'`},
+		{"it's", `'it'\''s'`},
+		{"$(rm -rf /); `id`", `'$(rm -rf /); ` + "`id`'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.s); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
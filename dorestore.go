@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/spf13/viper"
+)
+
+// default rsync arguments for restore to origin server,
+// ssh option '-e' is taken from 'rsyncargs' of group for the same identity as sync
+const defaultRestoreArgs = "-a --stats %s {{.LocalPath}} {{.SSHUser}}@{{.DNSName}}:{{.RemotePath}}"
+
+// default ssh option of restore, if not found in 'rsyncargs' of group
+const defaultRestoreSSH = "-e_ssh_-p_{{.Port}}"
+
+func dorestore(group, server, dir string) {
+	hostname := getHostName()
+	name := strings.Join([]string{group, server, dir}, "/")
+	/*
+		RUN CHECK'S
+	*/
+	exitWithMailMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		subj := fmt.Sprintf("zync'n'znap restore %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(group))
+		if err := sendReport(subj, msg); err != nil {
+			log.Printf("WARN: '%s'", err)
+		}
+		os.Exit(1)
+	}
+	keyOfServer := "groups." + group + ".servers." + server
+	keyOfDir := keyOfServer + ".dirs." + dir
+	if !viper.IsSet(keyOfDir) {
+		exitWithMailMsg(fmt.Sprintf("Dir '%s' not found in config", name))
+	}
+	zPath := path.Join(viper.GetString("ZfsPath"), group, server, dir)
+	ds, err := zfs.GetDataset(zPath)
+	if err != nil {
+		exitWithMailMsg(err.Error())
+	}
+	snaps, err := managedSnapshots(zPath)
+	if err != nil {
+		exitWithMailMsg(err.Error())
+	}
+	snap, err := resolveSnapshot(snaps, snapshot)
+	if err != nil {
+		exitWithMailMsg(fmt.Sprintf("Snapshot '%s' of '%s': %s", snapshot, name, err))
+	}
+	// source path inside snapshot
+	cleanSubpath := strings.TrimPrefix(path.Clean("/"+subpath), "/")
+	srcPath := filepath.Join(ds.Mountpoint, ".zfs", "snapshot", snap.snap, cleanSubpath)
+	srcStat, err := os.Stat(srcPath)
+	if err != nil {
+		exitWithMailMsg(err.Error())
+	}
+	if srcStat.IsDir() {
+		srcPath += "/"
+	}
+	// rsync arguments
+	var rsyncArgs []string
+	var destPath string
+	if toorigin {
+		if !viper.IsSet(keyOfServer + ".host") {
+			exitWithMailMsg(fmt.Sprintf("Hostname of server '%s' not found in config", server))
+		}
+		par := rsyncPar{
+			DNSName:   viper.GetString(keyOfServer + ".host"),
+			Port:      22,
+			SSHUser:   viper.GetString("SSHUser"),
+			LocalPath: srcPath,
+			LogPath: filepath.Join(viper.GetString("LogPath"),
+				strings.Join([]string{"restore", group, server, dir}, "-")+".log"),
+			CfgPath: cfgPath + "/",
+		}
+		if viper.IsSet(keyOfServer + ".port") {
+			par.Port = viper.GetInt(keyOfServer + ".port")
+		}
+		if viper.IsSet(keyOfServer + ".SSHUser") {
+			par.SSHUser = viper.GetString(keyOfServer + ".SSHUser")
+		}
+		par.RemotePath = path.Join(viper.GetString(keyOfDir+".remote"), cleanSubpath)
+		if srcStat.IsDir() {
+			par.RemotePath += "/"
+		}
+		sshArg := defaultRestoreSSH
+		for _, arg := range strings.Fields(viper.GetString("rsyncargs." + viper.GetString("groups."+group+".type"))) {
+			if strings.HasPrefix(arg, "-e") {
+				sshArg = arg
+			}
+		}
+		restoreArgs := fmt.Sprintf(defaultRestoreArgs, sshArg)
+		if viper.IsSet("restoreargs") {
+			restoreArgs = viper.GetString("restoreargs")
+		}
+		tmpl, err := template.New("restoreArgsTmpl").Parse(restoreArgs)
+		if err != nil {
+			exitWithMailMsg(fmt.Sprintf("Restore template error: %s", err))
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, par); err != nil {
+			exitWithMailMsg(fmt.Sprintf("Restore template error: %s", err))
+		}
+		rsyncArgs = strings.Fields(buf.String())
+		// if par like '-e_ssh_-p_22_-i_rsbackup.rsa'
+		// 		then change 'underscore' to 'space', only in options, not in paths
+		for i := 0; i < len(rsyncArgs); i++ {
+			if strings.HasPrefix(rsyncArgs[i], "-") {
+				rsyncArgs[i] = strings.Replace(rsyncArgs[i], "_", " ", -1)
+			}
+		}
+		destPath = par.SSHUser + "@" + par.DNSName + ":" + par.RemotePath
+	} else {
+		if _, err := os.Stat(target); os.IsNotExist(err) && !dryrun {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				exitWithMailMsg(err.Error())
+			}
+		}
+		destPath = strings.TrimSuffix(target, "/") + "/"
+		rsyncArgs = []string{"-a", "--stats", srcPath, destPath}
+	}
+	if dryrun {
+		rsyncArgs = append([]string{"--dry-run"}, rsyncArgs...)
+	}
+	/* end common check's */
+
+	/*
+		MAIN PROCEDURE
+	*/
+	log.Printf("INFO: restore '%s' from '%s' to '%s'", name, snap.name, destPath)
+	log.Printf("\trsync %s", strings.Join(rsyncArgs, " "))
+	timeStart := time.Now()
+	cmd := exec.Command("rsync", rsyncArgs...)
+	outputs, err := cmd.CombinedOutput()
+	result := "OK"
+	if err != nil {
+		result = "ERROR"
+		log.Println("\t\trsync output:\n" + string(outputs))
+	}
+	if dryrun {
+		result += " (dry-run)"
+	}
+
+	//
+	// make report
+	//
+	subj := fmt.Sprintf("zync'n'znap restore %s/%s: %s",
+		strings.ToUpper(hostname), strings.ToUpper(group), result)
+	msg := fmt.Sprintf("Dir:      %s\nSnapshot: %s (%s)\nSource:   %s\nTarget:   %s\nMinutes:  %.2f\n",
+		name, snap.snap, snap.creation.Format("2006-01-02 15:04"),
+		srcPath, destPath, time.Since(timeStart).Minutes())
+	msg += "\n" + strings.Repeat("-", 60) + "\n" + string(outputs)
+	if err != nil {
+		msg += "\n" + err.Error() + "\n"
+	}
+	// write report to logpath
+	if err := ioutil.WriteFile(
+		filepath.Join(viper.GetString("LogPath"), "restore-report.log"),
+		[]byte(subj+"\n\n"+msg), 0666); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	// send report
+	if err := sendReport(subj, msg); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+}
+
+// resolveSnapshot returns managed snapshot by name, date (20060102),
+// 'before:20060102[-1504]' or 'latest'
+func resolveSnapshot(snaps []managedSnap, spec string) (managedSnap, error) {
+	if len(snaps) == 0 {
+		return managedSnap{}, fmt.Errorf("no snapshots")
+	}
+	switch {
+	case spec == "" || spec == "latest":
+		return snaps[len(snaps)-1], nil
+	case strings.HasPrefix(spec, "before:"):
+		var before time.Time
+		var err error
+		value := strings.TrimPrefix(spec, "before:")
+		if len(value) > len("20060102") {
+			before, err = time.ParseInLocation("20060102-1504", value, time.Local)
+		} else {
+			before, err = time.ParseInLocation("20060102", value, time.Local)
+		}
+		if err != nil {
+			return managedSnap{}, err
+		}
+		for i := len(snaps) - 1; i >= 0; i-- {
+			if snaps[i].creation.Before(before) {
+				return snaps[i], nil
+			}
+		}
+	default:
+		for i := len(snaps) - 1; i >= 0; i-- {
+			if snaps[i].snap == spec {
+				return snaps[i], nil
+			}
+		}
+		// newest snapshot of date
+		if _, err := time.Parse("20060102", spec); err == nil {
+			for i := len(snaps) - 1; i >= 0; i-- {
+				if strings.HasPrefix(snaps[i].snap, spec) {
+					return snaps[i], nil
+				}
+			}
+		}
+	}
+	return managedSnap{}, fmt.Errorf("not found")
+}
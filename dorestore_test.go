@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveSnapshot(t *testing.T) {
+	snap := func(name string, at time.Time) managedSnap {
+		return managedSnap{name: "pool/g/s/d@" + name, snap: name, creation: at}
+	}
+	snaps := []managedSnap{
+		snap("20261017d", time.Date(2026, 10, 17, 1, 0, 0, 0, time.Local)),
+		snap("20261018d", time.Date(2026, 10, 18, 1, 0, 0, 0, time.Local)),
+		snap("20261018-1200h", time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)),
+		snap("20261019d", time.Date(2026, 10, 19, 1, 0, 0, 0, time.Local)),
+	}
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"", "20261019d", false},
+		{"latest", "20261019d", false},
+		{"20261018d", "20261018d", false},
+		{"20261018", "20261018-1200h", false},
+		{"before:20261019", "20261018-1200h", false},
+		{"before:20261018-1100", "20261018d", false},
+		{"before:20261017", "", true},
+		{"before:2026-10-18", "", true},
+		{"20261016", "", true},
+		{"20261016d", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveSnapshot(snaps, tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveSnapshot(%q) error = %v, want error %t", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got.snap != tt.want {
+			t.Errorf("resolveSnapshot(%q) = %q, want %q", tt.spec, got.snap, tt.want)
+		}
+	}
+	if _, err := resolveSnapshot(nil, "latest"); err == nil {
+		t.Errorf("resolveSnapshot(nil) error = nil, want error")
+	}
+}
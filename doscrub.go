@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type zpoolVdev struct {
+	name  string // with indent from 'zpool status'
+	state string
+	read  string
+	write string
+	cksum string
+}
+
+type zpoolInfo struct {
+	name          string
+	state         string
+	scan          string
+	scrubbing     bool
+	lastScrub     time.Time
+	fragmentation string
+	errors        string
+	vdevs         []zpoolVdev
+}
+
+func doscrub() {
+	hostname := getHostName()
+	poolName := strings.Split(viper.GetString("ZfsPath"), "/")[0]
+	/*
+		RUN CHECK'S
+	*/
+	exitWithMailMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		subj := fmt.Sprintf("zync'n'znap scrub %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(poolName))
+		if err := sendReport(subj, msg); err != nil {
+			log.Printf("WARN: '%s'", err)
+		}
+		os.Exit(1)
+	}
+	info, err := getZpoolInfo(poolName)
+	if err != nil {
+		exitWithMailMsg(err.Error())
+	}
+	// age of last scrub in days, default 30
+	scrubAge := 30
+	if viper.IsSet("ScrubAge") {
+		scrubAge = viper.GetInt("ScrubAge")
+	}
+	if scrubAge <= 0 {
+		exitWithMailMsg(fmt.Sprintf("'ScrubAge' = %d, must be greater than zero", scrubAge))
+	}
+	/* end common check's */
+
+	/*
+		MAIN PROCEDURE
+	*/
+	var result string
+	nextScrub := info.lastScrub.Add(time.Hour * 24 * time.Duration(scrubAge))
+	switch {
+	case info.scrubbing:
+		result = "in progress"
+		log.Printf("INFO: scrub of '%s' in progress, skip", poolName)
+	case info.lastScrub.IsZero() || time.Now().After(nextScrub):
+		log.Printf("INFO: last scrub of '%s' older than %d days, start scrub", poolName, scrubAge)
+		cmd := exec.Command("zpool", "scrub", poolName)
+		if outputs, err := cmd.CombinedOutput(); err != nil {
+			result = "start error"
+			log.Printf("ERROR: zpool scrub: %s, %s", outputs, err)
+			info.errors += fmt.Sprintf("\nzpool scrub: %s, %s", strings.TrimSpace(string(outputs)), err)
+		} else {
+			result = "started"
+		}
+	default:
+		result = "not needed"
+		log.Printf("INFO: next scrub of '%s' after %s", poolName, nextScrub.Format("2006-01-02"))
+	}
+
+	//
+	// make report
+	//
+	subj := fmt.Sprintf("zync'n'znap scrub %s/%s: %s, scrub %s",
+		strings.ToUpper(hostname), strings.ToUpper(poolName), info.state, result)
+	msg := info.summary()
+	if result == "not needed" {
+		msg += fmt.Sprintf("\nNext scrub after %s\n", nextScrub.Format("2006-01-02"))
+	}
+	// write report to logpath
+	err = ioutil.WriteFile(
+		filepath.Join(viper.GetString("LogPath"), "scrub-report.log"),
+		[]byte(subj+"\n\n"+msg), 0666)
+	if err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	// send report
+	if err := sendReport(subj, msg); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+}
+
+// getZpoolInfo reads state of pool from 'zpool status' and 'zpool get'
+func getZpoolInfo(name string) (zpoolInfo, error) {
+	info := zpoolInfo{name: name}
+	var stderr bytes.Buffer
+	cmd := exec.Command("zpool", "status", "-p", name)
+	cmd.Stderr = &stderr
+	outputs, err := cmd.Output()
+	if err != nil {
+		return info, fmt.Errorf("zpool status: %s, %s", strings.TrimSpace(stderr.String()), err)
+	}
+	inConfig := false
+	for _, s := range strings.Split(string(outputs), "\n") {
+		trimmed := strings.TrimSpace(s)
+		switch {
+		case strings.HasPrefix(trimmed, "state:"):
+			info.state = strings.TrimSpace(strings.TrimPrefix(trimmed, "state:"))
+		case strings.HasPrefix(trimmed, "scan:"):
+			info.scan = strings.TrimSpace(strings.TrimPrefix(trimmed, "scan:"))
+		case strings.HasPrefix(trimmed, "errors:"):
+			info.errors = strings.TrimSpace(strings.TrimPrefix(trimmed, "errors:"))
+			inConfig = false
+		case strings.HasPrefix(trimmed, "NAME"):
+			inConfig = true
+		case inConfig && trimmed != "":
+			f := strings.Fields(trimmed)
+			indent := s[:len(s)-len(strings.TrimLeft(s, " \t"))]
+			vdev := zpoolVdev{
+				name:  strings.TrimPrefix(indent, "\t") + f[0],
+				state: "-", read: "-", write: "-", cksum: "-",
+			}
+			if len(f) >= 5 {
+				vdev.state, vdev.read, vdev.write, vdev.cksum = f[1], f[2], f[3], f[4]
+			}
+			info.vdevs = append(info.vdevs, vdev)
+		}
+	}
+	info.scrubbing = strings.HasPrefix(info.scan, "scrub in progress")
+	if info.lastScrub, err = lastScrubDate(info.scan); err != nil {
+		log.Printf("WARN: parse scrub date '%s': %s", info.scan, err)
+	}
+	// fragmentation
+	stderr.Reset()
+	cmd = exec.Command("zpool", "get", "-Hp", "-o", "value", "fragmentation", name)
+	cmd.Stderr = &stderr
+	if outputs, err := cmd.Output(); err != nil {
+		log.Printf("WARN: zpool get fragmentation: %s, %s", strings.TrimSpace(stderr.String()), err)
+		info.fragmentation = "err"
+	} else {
+		info.fragmentation = strings.TrimSpace(string(outputs))
+		if info.fragmentation != "-" && !strings.HasSuffix(info.fragmentation, "%") {
+			info.fragmentation += "%"
+		}
+	}
+	return info, nil
+}
+
+// summary returns state of pool for reports
+func (info zpoolInfo) summary() string {
+	lastScrub := "never"
+	if !info.lastScrub.IsZero() {
+		lastScrub = info.lastScrub.Format("2006-01-02 15:04")
+	}
+	msg := fmt.Sprintf("Zpool '%s' state: %s. Fragmentation: %s. Last scrub: %s\n",
+		info.name, info.state, info.fragmentation, lastScrub)
+	msg += fmt.Sprintf("Scan: %s\n", info.scan)
+	msg += fmt.Sprintf("%-30s | %9s | %6s | %6s | %6s |\n",
+		"Vdev", "State", "Read", "Write", "Cksum")
+	for _, vdev := range info.vdevs {
+		msg += fmt.Sprintf("%-30s | %9s | %6s | %6s | %6s |\n",
+			vdev.name, vdev.state, vdev.read, vdev.write, vdev.cksum)
+	}
+	msg += fmt.Sprintf("Errors: %s\n", info.errors)
+	return msg
+}
+
+// lastScrubDate returns date of completed scrub from 'scan:' line of 'zpool status',
+// zero time for scrub in progress, canceled scrub and resilver:
+// "scrub repaired 0B in 00:01:23 with 0 errors on Sun Oct 11 00:25:24 2026"
+func lastScrubDate(scan string) (time.Time, error) {
+	if !strings.HasPrefix(scan, "scrub repaired") {
+		return time.Time{}, nil
+	}
+	i := strings.LastIndex(scan, " on ")
+	if i < 0 {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(scan[i+4:]), time.Local)
+}
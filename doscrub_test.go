@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastScrubDate(t *testing.T) {
+	tests := []struct {
+		scan    string
+		want    time.Time
+		wantErr bool
+	}{
+		{"scrub repaired 0B in 00:01:23 with 0 errors on Sun Oct 11 00:25:24 2026",
+			time.Date(2026, 10, 11, 0, 25, 24, 0, time.Local), false},
+		{"scrub repaired 0B in 0 days 02:10:05 with 0 errors on Mon Oct  5 02:34:05 2026",
+			time.Date(2026, 10, 5, 2, 34, 5, 0, time.Local), false},
+		{"scrub in progress since Sun Oct 18 00:24:01 2026", time.Time{}, false},
+		{"scrub canceled on Sun Oct 18 00:30:00 2026", time.Time{}, false},
+		{"resilvered 1.20G in 00:05:12 with 0 errors on Sat Oct 17 10:00:00 2026", time.Time{}, false},
+		{"none requested", time.Time{}, false},
+		{"", time.Time{}, false},
+		{"scrub repaired 0B in 00:01:23 with 0 errors on yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := lastScrubDate(tt.scan)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("lastScrubDate(%q) error = %v, want error %t", tt.scan, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !got.Equal(tt.want) {
+			t.Errorf("lastScrubDate(%q) = %s, want %s", tt.scan, got, tt.want)
+		}
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,21 +20,55 @@ import (
 )
 
 type snapTotals struct {
-	warnMsg   string
-	warnNum   int
-	ErrMsg    string
-	ErrNum    int
-	TotalDirs int
-	report    string
+	warnMsg    string
+	warnNum    int
+	ErrMsg     string
+	ErrNum     int
+	TotalDirs  int
+	report     string
+	diffReport string
 }
 
-func dosnap() {
+// managedSnap - snapshot created by task 'snap'
+type managedSnap struct {
+	name       string // full name: dataset@snap
+	snap       string // name after '@'
+	label      string // h | d | w | q
+	creation   time.Time
+	used       uint64
+	referenced uint64
+}
+
+// names of snapshots created by task 'snap'
+var managedSnapRe = regexp.MustCompile(`^(\d{8}-\d{4}h|\d{8}[dwq])$`)
+
+// snapSpace - space accounting of dir datasets, in bytes
+type snapSpace struct {
+	used        uint64
+	usedBySnaps uint64
+	written     uint64
+	freed       uint64
+}
+
+func (sp *snapSpace) add(other snapSpace) {
+	sp.used += other.used
+	sp.usedBySnaps += other.usedBySnaps
+	sp.written += other.written
+	sp.freed += other.freed
+}
+
+func dosnap(group string) {
 	hostname := getHostName()
+	// report label: group list or "all"
+	groupLabel := group
+	if groupLabel == "" {
+		groupLabel = "all"
+	}
 	var zpoolSummary string
 	if tank, err := zfs.GetZpool(strings.Split(viper.GetString("ZfsPath"), "/")[0]); err != nil {
 		log.Printf("Exit with fatal error: %s\n", err)
-		subj := fmt.Sprintf("zync'n'znap snap %s: Exit with fatal error",
-			strings.ToUpper(hostname))
+		subj := fmt.Sprintf("zync'n'znap snap %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(groupLabel))
 		if err := sendReport(subj, err.Error()); err != nil {
 			log.Printf("WARN: '%s'", err)
 		}
@@ -40,12 +78,18 @@ func dosnap() {
 			tank.Name, tank.Health,
 			strings.Split(humanize.Commaf(float64(tank.Allocated)/1024/1024/1024), ".")[0],
 			strings.Split(humanize.Commaf(float64(tank.Free)/1024/1024/1024), ".")[0])
+		if info, err := getZpoolInfo(tank.Name); err != nil {
+			log.Printf("WARN: '%s'", err)
+			zpoolSummary += fmt.Sprintf("\nWARN: '%s'", err)
+		} else {
+			zpoolSummary += "\n" + info.summary()
+		}
 	}
 	// check root backup path
 	if _, err := zfs.GetDataset(viper.GetString("ZfsPath")); err != nil {
 		log.Printf("Exit with fatal error: %s\n", err)
-		subj := fmt.Sprintf("zync'n'znap snap %s: Exit with fatal error",
-			strings.ToUpper(hostname))
+		subj := fmt.Sprintf("zync'n'znap snap %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(groupLabel))
 		if err := sendReport(subj, err.Error()); err != nil {
 			log.Printf("WARN: '%s'", err)
 		}
@@ -57,13 +101,19 @@ func dosnap() {
 		MAIN PROCEDURE
 	*/
 	delimeter := func() string {
-		return "\n" + strings.Repeat("-", 52) + "\n"
+		return "\n" + strings.Repeat("-", 116) + "\n"
 	}
 	totals := snapTotals{
-		report: fmt.Sprintf("%-25s | %7s | %12s |",
-			"Group/Server/Dir", "New", "Delete"),
+		report: fmt.Sprintf("%-25s | %7s | %12s | %11s | %11s | %11s | %5s | %11s |",
+			"Group/Server/Dir", "New", "Delete",
+			"Used Mb", "Snaps Mb", "Written Mb", "Ratio", "Freed Mb"),
 	}
 	totals.report += delimeter()
+	reportRow := func(name, newSnapResult, delSnapResult string, sp snapSpace, ratio string) string {
+		return fmt.Sprintf("%-25s | %7s | %12s | %11s | %11s | %11s | %5s | %11s |\n",
+			name, newSnapResult, delSnapResult,
+			sizeMb(sp.used), sizeMb(sp.usedBySnaps), sizeMb(sp.written), ratio, sizeMb(sp.freed))
+	}
 
 	// calculate snapshot name
 	getStorageTime := func(label string) int {
@@ -83,7 +133,10 @@ func dosnap() {
 	t := time.Now()
 	var snapLabel string
 	storagePeriod := 0
-	if t.Weekday() != time.Saturday {
+	if hourly {
+		snapLabel = "h"
+		storagePeriod = getStorageTime("h")
+	} else if t.Weekday() != time.Saturday {
 		snapLabel = "d"
 		storagePeriod = getStorageTime("d")
 	} else {
@@ -97,23 +150,29 @@ func dosnap() {
 			storagePeriod = getStorageTime("w")
 		}
 	}
-	snapName := t.Format("20060102") + snapLabel
+	snapUnit := snapPeriodUnit(snapLabel)
+	snapName := snapNameAt(t, snapLabel)
 	var oldSnapName string
 	if storagePeriod == 0 {
-		oldSnapName = t.Add(-time.Hour*24*(365*10)).Format("20060102") + snapLabel
+		oldSnapName = snapNameAt(t.Add(-time.Hour*24*(365*10)), snapLabel)
 	} else {
-		oldSnapName = t.Add(-time.Hour*24*time.Duration(storagePeriod)).Format("20060102") + snapLabel
+		oldSnapName = snapNameAt(t.Add(-snapUnit*time.Duration(storagePeriod)), snapLabel)
 	}
 	log.Printf("INFO: 'newSnapName' = %s", snapName)
 	log.Printf("INFO: 'oldSnapName' = %s", oldSnapName)
 
+	// using 'logTotals' in local checks
+	logWarnTotals := func(totals *snapTotals, msg string) {
+		totals.warnNum++
+		totals.warnMsg += msg
+		log.Printf(msg)
+	}
 	// enumerate backups and check path
-	for group := range viper.GetStringMap("groups") {
-		// using 'logTotals' in local checks
-		logWarnTotals := func(totals *snapTotals, msg string) {
-			totals.warnNum++
-			totals.warnMsg += msg
-			log.Printf(msg)
+	for _, group := range snapGroups(group) {
+		if !viper.IsSet("groups." + group) {
+			msg := fmt.Sprintf("WARN: skip group '%s', not found in config\n", group)
+			logWarnTotals(&totals, msg)
+			continue
 		}
 		zPath := path.Join(viper.GetString("ZfsPath"), group)
 		if _, err := zfs.GetDataset(zPath); err != nil {
@@ -122,6 +181,7 @@ func dosnap() {
 			logWarnTotals(&totals, msg)
 			continue
 		}
+		var groupSpace snapSpace
 		//
 		// enumerate servers
 		//
@@ -133,6 +193,7 @@ func dosnap() {
 				logWarnTotals(&totals, msg)
 				continue
 			}
+			var serverSpace snapSpace
 			//
 			// enumerate dirs
 			//
@@ -143,8 +204,8 @@ func dosnap() {
 					msg := fmt.Sprintf("    WARN: skip dir '%s/%s/%s', error: '%s'\n",
 						group, server, dir, err.Error())
 					logWarnTotals(&totals, msg)
-					totals.report += fmt.Sprintf("%-25s | %7s | %12s |\n",
-						fmt.Sprintf("%s/%s/%s", group, server, dir), "ERROR", "ERROR")
+					totals.report += reportRow(fmt.Sprintf("%s/%s/%s", group, server, dir),
+						"ERROR", "ERROR", snapSpace{}, "-")
 					continue
 				}
 				logSnapErrTotals := func(totals *snapTotals, msg string) {
@@ -155,6 +216,7 @@ func dosnap() {
 				totals.TotalDirs++
 				newSnapResult := "SKIP"
 				delSnapResult := "SKIP"
+				var dirSpace snapSpace
 				// make snap
 				if _, err := ds.Snapshot(snapName, false); err != nil {
 					msg := fmt.Sprintf("\tERROR: '%s/%s/%s', error: '%s'\n",
@@ -166,13 +228,28 @@ func dosnap() {
 					// if snap without error
 					log.Printf("\tSNAP: '%s/%s/%s' = OK\n", group, server, dir)
 					newSnapResult = "OK"
+					// changes since previous snapshot
+					if viper.GetBool("SnapDiff") {
+						if sum, err := snapDiff(zPath); err != nil {
+							log.Printf("\tWARN: diff of '%s': %s", zPath, err)
+							totals.diffReport += fmt.Sprintf("%s/%s/%s: %s\n", group, server, dir, err)
+						} else {
+							totals.diffReport += sum.report(fmt.Sprintf("%s/%s/%s", group, server, dir))
+						}
+					}
+					// space written since previous snapshot
+					if props, err := zfsGetProps(zPath+"@"+snapName, "written"); err != nil {
+						log.Printf("\tWARN: get 'written' of '%s@%s': %s", zPath, snapName, err)
+					} else {
+						dirSpace.written = propUint(props, "written")
+					}
 					var oldSnapNameDir = oldSnapName
 					// set local storageperiod?
 					var storageperiodKey = "groups." + group + ".servers." + server + ".dirs." + dir + ".storageperiod-" + snapLabel
 					if viper.IsSet(storageperiodKey) {
 						var storagePeriod = viper.GetInt(storageperiodKey)
 						if storagePeriod > 0 {
-							oldSnapNameDir = t.Add(-time.Hour*24*time.Duration(storagePeriod)).Format("20060102") + snapLabel
+							oldSnapNameDir = snapNameAt(t.Add(-snapUnit*time.Duration(storagePeriod)), snapLabel)
 							log.Printf("\tINFO: '%s' = %d , %s", storageperiodKey, storagePeriod, oldSnapNameDir)
 						} else {
 							log.Printf("\tWARN: '%s' not set or zero. Using default", storageperiodKey)
@@ -192,7 +269,17 @@ func dosnap() {
 							delSnapResult = "ERROR"
 							//goto end
 						} else {
+							var snapsBefore uint64
+							if props, err := zfsGetProps(zPath, "usedbysnapshots"); err == nil {
+								snapsBefore = propUint(props, "usedbysnapshots")
+							}
 							delSnapResult = "CHECK"
+							// last replicated snapshot of task 'replicate'
+							replicated := ""
+							if props, err := zfsGetProps(zPath, replicatedProperty); err == nil &&
+								props[replicatedProperty] != "-" {
+								replicated = props[replicatedProperty]
+							}
 							snapTotal := 0
 							snapDeleting := 0
 							snapDeleted := 0
@@ -200,6 +287,17 @@ func dosnap() {
 								if strings.HasSuffix(sn.Name, snapLabel) {
 									snapTotal++
 									if zPath+"@"+oldSnapNameDir > sn.Name {
+										// skip the last replicated snapshot without bookmark
+										if sn.Name == zPath+"@"+replicated && !zfsExist(zPath+"#"+replicated) {
+											log.Printf("\t\tskip '%s', last replicated without bookmark", sn.Name)
+											continue
+										}
+										// skip snapshots with clones of task 'mount'
+										if props, err := zfsGetProps(sn.Name, "clones"); err == nil &&
+											props["clones"] != "" && props["clones"] != "-" {
+											log.Printf("\t\tskip '%s', has clones '%s'", sn.Name, props["clones"])
+											continue
+										}
 										snapDeleting++
 										if err := sn.Destroy(zfs.DestroyDefault); err != nil {
 											msg := fmt.Sprintf("\tERROR: '%s/%s/%s', error: '%s'\n",
@@ -214,26 +312,50 @@ func dosnap() {
 							}
 							delSnapResult = fmt.Sprintf("%d/%d/%d",
 								snapDeleted, snapDeleting, snapTotal)
+							if snapDeleted > 0 {
+								if props, err := zfsGetProps(zPath, "usedbysnapshots"); err == nil &&
+									snapsBefore > propUint(props, "usedbysnapshots") {
+									dirSpace.freed = snapsBefore - propUint(props, "usedbysnapshots")
+								}
+							}
 						}
 					}
 				}
-				totals.report += fmt.Sprintf("%-25s | %7s | %12s |\n",
-					fmt.Sprintf("%s/%s/%s", group, server, dir), newSnapResult, delSnapResult)
+				// dataset space after snap and pruning
+				ratio := "-"
+				if props, err := zfsGetProps(zPath, "used", "usedbysnapshots", "compressratio"); err != nil {
+					log.Printf("\tWARN: get space of '%s': %s", zPath, err)
+				} else {
+					dirSpace.used = propUint(props, "used")
+					dirSpace.usedBySnaps = propUint(props, "usedbysnapshots")
+					ratio = strings.TrimSuffix(props["compressratio"], "x") + "x"
+				}
+				serverSpace.add(dirSpace)
+				totals.report += reportRow(fmt.Sprintf("%s/%s/%s", group, server, dir),
+					newSnapResult, delSnapResult, dirSpace, ratio)
 			}
+			groupSpace.add(serverSpace)
+			totals.report += reportRow(fmt.Sprintf("  %s/%s", group, server),
+				"", "total", serverSpace, "")
 		}
+		totals.report += reportRow(fmt.Sprintf("  %s", group),
+			"", "total", groupSpace, "")
 	}
 
 	//
 	// make report
 	//
 	subj := fmt.Sprintf("zync'n'znap snap %s/%s: err/warn/total = %d/%d/%d",
-		strings.ToUpper(hostname), strings.ToUpper(group),
+		strings.ToUpper(hostname), strings.ToUpper(groupLabel),
 		totals.ErrNum, totals.warnNum, totals.TotalDirs)
 	msg := zpoolSummary + delimeter() + totals.report + delimeter() +
 		totals.ErrMsg + delimeter() + totals.warnMsg
+	if totals.diffReport != "" {
+		msg += delimeter() + totals.diffReport
+	}
 	// write report to logpath
 	err := ioutil.WriteFile(
-		filepath.Join(viper.GetString("LogPath"), "snap-report.log"),
+		filepath.Join(viper.GetString("LogPath"), "snap-report"+snapReportSuffix(group)+".log"),
 		[]byte(subj+"\n\n"+msg), 0666)
 	if err != nil {
 		log.Printf("WARN: '%s'", err)
@@ -244,3 +366,87 @@ func dosnap() {
 	}
 
 }
+
+// snapNameAt returns the snapshot name for time 't' and label:
+// YYYYMMDD<label> for d/w/q, YYYYMMDD-HHMMh for hourly snapshots
+func snapNameAt(t time.Time, label string) string {
+	if label == "h" {
+		return t.Format("20060102-1504") + label
+	}
+	return t.Format("20060102") + label
+}
+
+// snapPeriodUnit returns the unit of 'storageperiod.<label>':
+// hours for hourly snapshots, days for others
+func snapPeriodUnit(label string) time.Duration {
+	if label == "h" {
+		return time.Hour
+	}
+	return time.Hour * 24
+}
+
+// snapGroups returns the list of groups for the snap task:
+// all groups from config if 'group' is empty,
+// otherwise comma separated names from command line
+func snapGroups(group string) []string {
+	var groups []string
+	if group == "" {
+		for g := range viper.GetStringMap("groups") {
+			groups = append(groups, g)
+		}
+		sort.Strings(groups)
+		return groups
+	}
+	for _, g := range strings.Split(group, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, strings.ToLower(g))
+		}
+	}
+	return groups
+}
+
+// snapReportSuffix returns the suffix of the snap report file name:
+// empty for all groups, like 'zip-report<group>.log' for others
+func snapReportSuffix(group string) string {
+	if group == "" {
+		return ""
+	}
+	return strings.Join(snapGroups(group), "-")
+}
+
+// managedSnapshots returns snapshots of dataset 'zPath' created by task 'snap',
+// sorted by creation time
+func managedSnapshots(zPath string) ([]managedSnap, error) {
+	cmd := exec.Command("zfs", "list", "-Hp", "-t", "snapshot", "-d", "1",
+		"-o", "name,creation,used,referenced", "-s", "creation", zPath)
+	outputs, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	var snaps []managedSnap
+	for _, s := range strings.Split(string(outputs), "\n") {
+		f := strings.Fields(s)
+		if len(f) != 4 || !strings.Contains(f[0], "@") {
+			continue
+		}
+		snap := f[0][strings.Index(f[0], "@")+1:]
+		if !managedSnapRe.MatchString(snap) {
+			continue
+		}
+		sec, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("creation of '%s': %s", f[0], err)
+		}
+		used, _ := strconv.ParseUint(f[2], 10, 64)
+		referenced, _ := strconv.ParseUint(f[3], 10, 64)
+		snaps = append(snaps, managedSnap{
+			name:       f[0],
+			snap:       snap,
+			label:      snap[len(snap)-1:],
+			creation:   time.Unix(sec, 0),
+			used:       used,
+			referenced: referenced,
+		})
+	}
+	return snaps, nil
+}
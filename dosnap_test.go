@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// readTestConfig replaces configuration with 'cfg' in TOML
+func readTestConfig(t *testing.T, cfg string) {
+	t.Helper()
+	viper.Reset()
+	viper.SetConfigType("toml")
+	if err := viper.ReadConfig(strings.NewReader(cfg)); err != nil {
+		t.Fatalf("read config: %s", err)
+	}
+	t.Cleanup(viper.Reset)
+}
+
+func TestSnapGroups(t *testing.T) {
+	readTestConfig(t, `
+[groups.web.servers.s.dirs.d]
+[groups.db.servers.s.dirs.d]
+[groups.mail.servers.s.dirs.d]
+`)
+	tests := []struct {
+		group string
+		want  []string
+	}{
+		{"", []string{"db", "mail", "web"}},
+		{"web", []string{"web"}},
+		{"Web, DB", []string{"web", "db"}},
+		{"web,,mail,", []string{"web", "mail"}},
+		{"unknown", []string{"unknown"}},
+	}
+	for _, tt := range tests {
+		if got := snapGroups(tt.group); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("snapGroups(%q) = %q, want %q", tt.group, got, tt.want)
+		}
+	}
+}
+
+func TestSnapNameAt(t *testing.T) {
+	at := time.Date(2026, 10, 9, 7, 5, 0, 0, time.Local)
+	tests := []struct {
+		label string
+		want  string
+	}{
+		{"d", "20261009d"},
+		{"w", "20261009w"},
+		{"q", "20261009q"},
+		{"h", "20261009-0705h"},
+	}
+	for _, tt := range tests {
+		if got := snapNameAt(at, tt.label); got != tt.want {
+			t.Errorf("snapNameAt(%s, %q) = %q, want %q", at, tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestManagedSnapRe(t *testing.T) {
+	tests := []struct {
+		snap string
+		want bool
+	}{
+		{"20261019d", true},
+		{"20261019w", true},
+		{"20261019q", true},
+		{"20261019-1530h", true},
+		{"20261019h", false},
+		{"20261019-1530d", false},
+		{"20261019", false},
+		{"2026101d", false},
+		{"20261019d-manual", false},
+		{"manual", false},
+		{"zyncnznap-20261019d", false},
+	}
+	for _, tt := range tests {
+		if got := managedSnapRe.MatchString(tt.snap); got != tt.want {
+			t.Errorf("managedSnapRe.MatchString(%q) = %t, want %t", tt.snap, got, tt.want)
+		}
+	}
+	// names of task 'snap' are managed
+	at := time.Date(2026, 10, 9, 7, 5, 0, 0, time.Local)
+	for _, label := range []string{"h", "d", "w", "q"} {
+		if name := snapNameAt(at, label); !managedSnapRe.MatchString(name) {
+			t.Errorf("snapNameAt(%s, %q) = %q, not managed snapshot", at, label, name)
+		}
+	}
+}
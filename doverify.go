@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/spf13/viper"
+)
+
+// verifyResult - comparison of dir dataset with replica
+type verifyResult struct {
+	common    int
+	missing   []string // managed snapshots not found on replica
+	divergent []string // same name, different guid
+	extra     int      // snapshots on replica only
+	checked   int      // sampled files with equal checksums
+	corrupt   []string // sampled files with different checksums
+	skipped   string   // reason of skipped checksums
+}
+
+func doverify(group string) {
+	hostname := getHostName()
+	groupLabel := group
+	if groupLabel == "" {
+		groupLabel = "all"
+	}
+	exitWithMailMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		subj := fmt.Sprintf("zync'n'znap verify %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(groupLabel))
+		if err := sendReport(subj, msg); err != nil {
+			log.Printf("WARN: '%s'", err)
+		}
+		os.Exit(1)
+	}
+	if !viper.IsSet("replicate.target") {
+		exitWithMailMsg("'replicate.target' not set in config")
+	}
+	targetRoot := viper.GetString("replicate.target")
+	// number of sampled files for checksums, default 0 - disabled
+	samples := viper.GetInt("replicate.verifysamples")
+	/* end common check's */
+
+	/*
+		MAIN PROCEDURE
+	*/
+	delimeter := func() string {
+		return "\n" + strings.Repeat("-", 85) + "\n"
+	}
+	totals := replicateTotals{
+		report: fmt.Sprintf("%-25s | %6s | %7s | %9s | %5s | %7s | %7s |",
+			"Group/Server/Dir", "Common", "Missing", "Divergent", "Extra", "Checked", "Corrupt"),
+	}
+	totals.report += delimeter()
+	for _, group := range snapGroups(group) {
+		if !viper.IsSet("groups." + group) {
+			totals.warnNum++
+			msg := fmt.Sprintf("WARN: skip group '%s', not found in config\n", group)
+			totals.warnMsg += msg
+			log.Printf(msg)
+			continue
+		}
+		for _, server := range sortedKeys(viper.GetStringMap("groups." + group + ".servers")) {
+			keyOfDirs := "groups." + group + ".servers." + server + ".dirs"
+			for _, dir := range sortedKeys(viper.GetStringMap(keyOfDirs)) {
+				name := fmt.Sprintf("%s/%s/%s", group, server, dir)
+				zPath := path.Join(viper.GetString("ZfsPath"), group, server, dir)
+				tPath := path.Join(targetRoot, group, server, dir)
+				totals.TotalDirs++
+				res, err := verifyDataset(zPath, tPath, samples)
+				if err != nil {
+					totals.ErrNum++
+					msg := fmt.Sprintf("\tERROR: '%s', error: '%s'\n", name, err.Error())
+					totals.ErrMsg += msg
+					log.Printf(msg)
+					totals.report += fmt.Sprintf("%-25s | %6s | %7s | %9s | %5s | %7s | %7s |\n",
+						name, "ERROR", "-", "-", "-", "-", "-")
+					continue
+				}
+				if len(res.missing)+len(res.divergent)+len(res.corrupt) > 0 {
+					totals.ErrNum++
+					msg := fmt.Sprintf("\tERROR: '%s'\n", name)
+					if len(res.missing) > 0 {
+						msg += fmt.Sprintf("\t\tmissing: %s\n", strings.Join(res.missing, ", "))
+					}
+					if len(res.divergent) > 0 {
+						msg += fmt.Sprintf("\t\tdivergent: %s\n", strings.Join(res.divergent, ", "))
+					}
+					if len(res.corrupt) > 0 {
+						msg += fmt.Sprintf("\t\tcorrupt: %s\n", strings.Join(res.corrupt, ", "))
+					}
+					totals.ErrMsg += msg
+					log.Printf(msg)
+				} else {
+					log.Printf("\tVERIFY: '%s' = OK\n", name)
+				}
+				checked := fmt.Sprintf("%d", res.checked)
+				if res.skipped != "" {
+					totals.warnNum++
+					msg := fmt.Sprintf("\tWARN: '%s', %s\n", name, res.skipped)
+					totals.warnMsg += msg
+					log.Printf(msg)
+					checked = "skip"
+				}
+				totals.report += fmt.Sprintf("%-25s | %6d | %7d | %9d | %5d | %7s | %7d |\n",
+					name, res.common, len(res.missing), len(res.divergent), res.extra,
+					checked, len(res.corrupt))
+			}
+		}
+	}
+
+	//
+	// make report
+	//
+	subj := fmt.Sprintf("zync'n'znap verify %s/%s: err/warn/total = %d/%d/%d",
+		strings.ToUpper(hostname), strings.ToUpper(groupLabel),
+		totals.ErrNum, totals.warnNum, totals.TotalDirs)
+	msg := fmt.Sprintf("Target: %s %s\n", viper.GetString("replicate.ssh"), targetRoot) +
+		delimeter() + totals.report + delimeter() + totals.ErrMsg + delimeter() + totals.warnMsg
+	// write report to logpath
+	err := ioutil.WriteFile(
+		filepath.Join(viper.GetString("LogPath"), "verify-report"+snapReportSuffix(group)+".log"),
+		[]byte(subj+"\n\n"+msg), 0666)
+	if err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	// send report
+	if err := sendReport(subj, msg); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+}
+
+// verifyDataset compares managed snapshots and guids of 'zPath' and replica 'tPath',
+// checksums of 'samples' random files of newest common snapshot,
+// snapshot of unmounted replica is mounted to temporary dir
+func verifyDataset(zPath, tPath string, samples int) (verifyResult, error) {
+	var res verifyResult
+	snaps, err := managedSnapshots(zPath)
+	if err != nil {
+		return res, err
+	}
+	localGuids, err := snapGuids(exec.Command("zfs", "list", "-Hp", "-t", "snapshot", "-d", "1",
+		"-o", "name,guid", zPath))
+	if err != nil {
+		return res, err
+	}
+	replicaGuids, err := snapGuids(replicaCommand("zfs", "list", "-Hp", "-t", "snapshot", "-d", "1",
+		"-o", "name,guid", tPath))
+	if err != nil {
+		return res, err
+	}
+	newestCommon := ""
+	managed := make(map[string]bool)
+	for _, sn := range snaps {
+		managed[sn.snap] = true
+		guid, ok := replicaGuids[sn.snap]
+		switch {
+		case !ok:
+			res.missing = append(res.missing, sn.snap)
+		case guid != localGuids[sn.snap]:
+			res.divergent = append(res.divergent, sn.snap)
+		default:
+			res.common++
+			newestCommon = sn.snap
+		}
+	}
+	for snap := range replicaGuids {
+		if !managed[snap] {
+			res.extra++
+		}
+	}
+	if samples <= 0 || newestCommon == "" {
+		return res, nil
+	}
+	// checksums of sampled files
+	ds, err := zfs.GetDataset(zPath)
+	if err != nil {
+		return res, err
+	}
+	props, err := replicaProps(tPath, "mountpoint", "mounted")
+	if err != nil {
+		return res, err
+	}
+	localRoot := filepath.Join(ds.Mountpoint, ".zfs", "snapshot", newestCommon)
+	replicaRoot := filepath.Join(props["mountpoint"], ".zfs", "snapshot", newestCommon)
+	if props["mounted"] != "yes" {
+		// replica is received with 'zfs receive -u', snapshot is mounted for checksums
+		dir, unmount, err := mountReplicaSnapshot(tPath + "@" + newestCommon)
+		if err != nil {
+			res.skipped = fmt.Sprintf("'%s' not mounted, checksums skipped: %s", tPath, err)
+			return res, nil
+		}
+		defer unmount()
+		replicaRoot = dir
+	}
+	for _, rel := range sampleFiles(localRoot, samples) {
+		localSum, err := fileSha256(filepath.Join(localRoot, rel))
+		if err != nil {
+			log.Printf("\tWARN: '%s': %s", rel, err)
+			continue
+		}
+		outputs, err := replicaCommand("sha256sum", filepath.Join(replicaRoot, rel)).Output()
+		if err != nil || len(strings.Fields(string(outputs))) == 0 ||
+			strings.Fields(string(outputs))[0] != localSum {
+			res.corrupt = append(res.corrupt, newestCommon+":"+rel)
+			continue
+		}
+		res.checked++
+	}
+	return res, nil
+}
+
+// mountReplicaSnapshot mounts snapshot of replica read-only to temporary dir,
+// returns dir and function to unmount and remove it
+func mountReplicaSnapshot(snap string) (string, func(), error) {
+	outputs, err := replicaCommand("mktemp", "-d").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("mktemp: %s", err)
+	}
+	dir := strings.TrimSpace(string(outputs))
+	if outputs, err := replicaCommand("mount", "-t", "zfs", "-o", "ro", snap, dir).CombinedOutput(); err != nil {
+		replicaCommand("rmdir", dir).Run()
+		return "", nil, fmt.Errorf("mount: %s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	return dir, func() {
+		if outputs, err := replicaCommand("umount", dir).CombinedOutput(); err != nil {
+			log.Printf("\tWARN: umount '%s': %s, %s", dir, strings.TrimSpace(string(outputs)), err)
+			return
+		}
+		replicaCommand("rmdir", dir).Run()
+	}, nil
+}
+
+// snapGuids returns guids of snapshots from 'zfs list -o name,guid'
+func snapGuids(cmd *exec.Cmd) (map[string]string, error) {
+	outputs, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	guids := make(map[string]string)
+	for _, s := range strings.Split(string(outputs), "\n") {
+		f := strings.Fields(s)
+		if len(f) == 2 && strings.Contains(f[0], "@") {
+			guids[f[0][strings.Index(f[0], "@")+1:]] = f[1]
+		}
+	}
+	return guids, nil
+}
+
+// replicaProps returns values of properties of target dataset
+func replicaProps(tPath string, props ...string) (map[string]string, error) {
+	outputs, err := replicaCommand("zfs", "get", "-Hp", "-o", "property,value",
+		strings.Join(props, ","), tPath).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", strings.TrimSpace(string(outputs)), err)
+	}
+	values := make(map[string]string)
+	for _, s := range strings.Split(string(outputs), "\n") {
+		if f := strings.Split(s, "\t"); len(f) == 2 {
+			values[f[0]] = f[1]
+		}
+	}
+	return values, nil
+}
+
+// sampleFiles returns up to 'n' random regular files under 'root'
+func sampleFiles(root string, n int) []string {
+	var files []string
+	seen := 0
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		// reservoir sampling
+		seen++
+		if len(files) < n {
+			files = append(files, rel)
+		} else if i := rnd.Intn(seen); i < n {
+			files[i] = rel
+		}
+		return nil
+	})
+	return files
+}
+
+func fileSha256(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
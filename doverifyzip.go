@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// verifyZipTotals - totals of task 'verifyzip'
+type verifyZipTotals struct {
+	warnMsg    string
+	warnNum    int
+	corruptMsg string
+	corruptNum int
+	missingMsg string
+	missingNum int
+	totalNum   int
+	report     string
+}
+
+// doverifyzip re-reads archives of dirs of groups in ZipPath,
+// compares checksums with sidecars '.sha256' and the newest manifest of group
+// and tests integrity of archives
+func doverifyzip(group string) {
+	hostname := getHostName()
+	groupLabel := group
+	if groupLabel == "" {
+		groupLabel = "all"
+	}
+	exitWithMailMsg := func(msg string) {
+		log.Printf("Exit with fatal error: %s\n", msg)
+		subj := fmt.Sprintf("zync'n'znap verifyzip %s/%s: Exit with fatal error",
+			strings.ToUpper(hostname), strings.ToUpper(groupLabel))
+		if err := sendReport(subj, msg); err != nil {
+			log.Printf("WARN: '%s'", err)
+		}
+		os.Exit(1)
+	}
+	zipPath := viper.GetString("ZipPath")
+	list, err := zipDirArchives(zipPath)
+	if err != nil {
+		exitWithMailMsg(fmt.Sprintf("Read path '%s' for zip: %s", zipPath, err))
+	}
+	// archives by prefix of dir, 'group_server_dir_'
+	archives := make(map[string][]zipArchive)
+	for _, a := range list {
+		archives[a.prefix] = append(archives[a.prefix], a)
+	}
+	// test of encrypted archives only if secret key is set
+	secretKey := ""
+	if viper.IsSet("ArchiveSecretKey") {
+		secretKey = filepath.Join(cfgPath, viper.GetString("ArchiveSecretKey"))
+	}
+	/* end common check's */
+
+	/*
+		MAIN PROCEDURE
+	*/
+	delimeter := func() string {
+		return "\n" + strings.Repeat("-", 98) + "\n"
+	}
+	totals := verifyZipTotals{
+		report: fmt.Sprintf("%-50s | %12s | %8s | %8s | %7s |",
+			"Archive", "Size in Mb", "Checksum", "Test", "Entries"),
+	}
+	totals.report += delimeter()
+	for _, group := range snapGroups(group) {
+		if !viper.IsSet("groups." + group) {
+			totals.warnNum++
+			msg := fmt.Sprintf("WARN: skip group '%s', not found in config\n", group)
+			totals.warnMsg += msg
+			log.Printf(msg)
+			continue
+		}
+		log.Printf("- Verify archives of group '%s'\n", group)
+		// the newest manifest of group
+		manifestName, manifest, err := newestManifest(zipPath, group)
+		if err != nil {
+			totals.warnNum++
+			msg := fmt.Sprintf("  WARN: manifest of group '%s': %s\n", group, err)
+			totals.warnMsg += msg
+			log.Printf(msg)
+		}
+		for _, server := range sortedKeys(viper.GetStringMap("groups." + group + ".servers")) {
+			keyOfDirs := "groups." + group + ".servers." + server + ".dirs"
+			for _, dir := range sortedKeys(viper.GetStringMap(keyOfDirs)) {
+				prefix, err := zipPrefix(group, server, dir)
+				if err != nil {
+					totals.warnNum++
+					msg := fmt.Sprintf("  WARN: skip dir '%s/%s/%s', archivename: %s\n", group, server, dir, err)
+					totals.warnMsg += msg
+					log.Printf(msg)
+					continue
+				}
+				dirArchives := archives[prefix]
+				sort.Slice(dirArchives, func(i, j int) bool {
+					return dirArchives[i].name < dirArchives[j].name
+				})
+				for _, a := range dirArchives {
+					totals.totalNum++
+					name := a.name
+					fsize := sizeMb(uint64(a.size))
+					checksum, test, numEntries := "OK", "OK", "-"
+					corrupt := ""
+					if a.volumes != nil {
+						fsize = fmt.Sprintf("%d x %s", len(a.volumes), fsize)
+					}
+					// checksum of file or stream of volumes, nothing is written to ZipPath
+					sum := ""
+					r, err := openZipArchive(zipPath, a)
+					if err == nil {
+						sum, err = readerSha256(r)
+						r.Close()
+					}
+					if err != nil {
+						checksum = "ERROR"
+						corrupt += fmt.Sprintf("  ERROR: '%s': %s\n", name, err)
+					}
+					sidecar, err := readChecksums(filepath.Join(zipPath, name+".sha256"))
+					switch {
+					case err != nil:
+						checksum = "MISSING"
+						totals.missingNum++
+						msg := fmt.Sprintf("  WARN: '%s': checksum file not found\n", name)
+						totals.missingMsg += msg
+						log.Printf(msg)
+					case sum != "" && sidecar[name] != sum:
+						checksum = "BAD"
+						corrupt += fmt.Sprintf("  ERROR: '%s': checksum mismatch with '%s.sha256'\n", name, name)
+					}
+					if s, ok := manifest[name]; ok && sum != "" && s != sum {
+						checksum = "BAD"
+						corrupt += fmt.Sprintf("  ERROR: '%s': checksum mismatch with '%s'\n", name, manifestName)
+					}
+					// test integrity
+					if strings.HasSuffix(name, ".gpg") && secretKey == "" {
+						test = "SKIP"
+					} else if n, err := testZipArchive(zipPath, a, secretKey); err != nil {
+						test = "ERROR"
+						corrupt += fmt.Sprintf("  ERROR: '%s': %s\n", name, err)
+					} else {
+						numEntries = fmt.Sprintf("%d", n)
+					}
+					if corrupt != "" {
+						totals.corruptNum++
+						totals.corruptMsg += corrupt
+						log.Printf(corrupt)
+					}
+					log.Printf("  '%s': checksum %s, test %s\n", name, checksum, test)
+					totals.report += fmt.Sprintf("%-50s | %12s | %8s | %8s | %7s |\n",
+						name, fsize, checksum, test, numEntries)
+				}
+			}
+		}
+		// archives of the newest manifest must exist
+		var listed []string
+		for name := range manifest {
+			listed = append(listed, name)
+		}
+		sort.Strings(listed)
+		for _, name := range listed {
+			_, err := os.Stat(filepath.Join(zipPath, name))
+			if os.IsNotExist(err) {
+				// split to volumes
+				_, err = os.Stat(filepath.Join(zipPath, name+".parts"))
+			}
+			if os.IsNotExist(err) {
+				totals.missingNum++
+				msg := fmt.Sprintf("  ERROR: '%s' from '%s' not found\n", name, manifestName)
+				totals.missingMsg += msg
+				log.Printf(msg)
+			}
+		}
+	}
+
+	//
+	// make report
+	//
+	subj := fmt.Sprintf("zync'n'znap verifyzip %s/%s: corrupt/missing/total = %d/%d/%d",
+		strings.ToUpper(hostname), strings.ToUpper(groupLabel),
+		totals.corruptNum, totals.missingNum, totals.totalNum)
+	msg := totals.report + delimeter() + totals.corruptMsg + delimeter() + totals.missingMsg +
+		delimeter() + totals.warnMsg
+	// write report to logpath
+	err = ioutil.WriteFile(
+		filepath.Join(viper.GetString("LogPath"), "verifyzip-report"+snapReportSuffix(group)+".log"),
+		[]byte(subj+"\n\n"+msg), 0666)
+	if err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+	// send report
+	if err := sendReport(subj, msg); err != nil {
+		log.Printf("WARN: '%s'", err)
+	}
+}
+
+// newestManifest returns name and checksums of the newest manifest
+// 'zip-manifest_<group>_YYYYMMDD-HHMM.sha256' in 'zipPath'
+func newestManifest(zipPath, group string) (string, map[string]string, error) {
+	manifests, err := filepath.Glob(filepath.Join(zipPath, "zip-manifest_"+group+"_*.sha256"))
+	if err != nil || len(manifests) == 0 {
+		return "", nil, err
+	}
+	sort.Strings(manifests)
+	fileName := manifests[len(manifests)-1]
+	sums, err := readChecksums(fileName)
+	return filepath.Base(fileName), sums, err
+}
+
+// readChecksums reads file in 'sha256sum' format, returns checksums by file names
+func readChecksums(fileName string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	for _, s := range strings.Split(string(data), "\n") {
+		// '<sha256>  <name>', '*' before name in binary mode, '#' - comment
+		if strings.HasPrefix(s, "#") {
+			continue
+		}
+		if f := strings.SplitN(s, " ", 2); len(f) == 2 {
+			sums[strings.TrimLeft(f[1], " *")] = f[0]
+		}
+	}
+	return sums, nil
+}
+
+// openZipArchive opens archive file or stream of its volumes in 'zipPath'
+func openZipArchive(zipPath string, a zipArchive) (io.ReadCloser, error) {
+	if a.volumes != nil {
+		return openVolumes(filepath.Join(zipPath, a.name+".parts"))
+	}
+	return os.Open(filepath.Join(zipPath, a.name))
+}
+
+func readerSha256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// testZipArchive reads all entries of archive, returns number of entries.
+// Encrypted archive is decrypted and split zip (random access) is joined
+// to temporary file in os.TempDir(), not in ZipPath copied to external media.
+func testZipArchive(zipPath string, a zipArchive, secretKey string) (int, error) {
+	format := archiveFileFormat(a.name)
+	encrypted := strings.HasSuffix(a.name, ".gpg")
+	if !encrypted && a.volumes == nil {
+		return verifyArchive(format, filepath.Join(zipPath, a.name))
+	}
+	r, err := openZipArchive(zipPath, a)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if !encrypted && format != "zip" {
+		return verifyTar(format, r)
+	}
+	plainFile, err := tempPlainFile(a.name)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(plainFile)
+	if encrypted {
+		err = decryptStream(r, plainFile, secretKey)
+	} else {
+		err = copyToFile(r, plainFile)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return verifyArchive(format, plainFile)
+}
+
+func copyToFile(r io.Reader, fileName string) error {
+	out, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 	"time"
 
-	"github.com/dustin/go-humanize"
+	"github.com/mistifyio/go-zfs"
 	"github.com/spf13/viper"
 )
 
@@ -20,9 +25,45 @@ type ZipTotals struct {
 	zipErrMsg    string
 	zipErrorTask int
 	zipTotalTask int
+	fileErrMsg   string
+	fileErrNum   int
+	deletedMsg   string
 	report       string
 }
 
+// zipArchive - archive file in ZipPath, named by template 'archivename',
+// default 'group_server_dir_YYYYMMDD...'
+type zipArchive struct {
+	name    string
+	prefix  string // part of name before snapshot, 'group_server_dir_'
+	snap    string // snapshot of archive
+	inc     bool   // incremental archive
+	date    time.Time
+	size    int64
+	volumes []string // volumes of archive split by 'volumesize', paths in ZipPath
+	sidecar bool     // checksum file '.sha256' exists, archive is complete
+}
+
+// zipNameData - fields of template 'archivename' of group or dir
+type zipNameData struct {
+	Group    string
+	Server   string
+	Dir      string
+	Host     string
+	Snapshot string    // name of snapshot, '20060102d'
+	Label    string    // label of snapshot: h | d | w | q
+	Date     time.Time // creation of snapshot
+}
+
+// default template of archive name, without extension
+const defaultZipName = "{{.Group}}_{{.Server}}_{{.Dir}}_{{.Snapshot}}"
+
+// archives in ZipPath, '.parts' - manifest of volumes
+var zipArchiveRe = regexp.MustCompile(`\.(zip|tar\.gz|tar\.zst)(\.gpg)?(\.parts)?$`)
+
+// snapshot in name of archive after prefix of dir
+var zipSnapRe = regexp.MustCompile(`^(\d{8}-\d{4}h|\d{8}[dwq])`)
+
 func dozip(group string) {
 	hostname := getHostName()
 	/*
@@ -65,16 +106,18 @@ func dozip(group string) {
 		MAIN PROCEDURE
 	*/
 	delimeter := func() string {
-		return "\n" + strings.Repeat("-", 60) + "\n"
+		return "\n" + strings.Repeat("-", 98) + "\n"
 	}
 	totals := ZipTotals{
-		report: fmt.Sprintf("%-25s | %20s | %7s |",
-			"Group/Server/Dir", "Size in Mb", "Minutes"),
+		report: fmt.Sprintf("%-25s | %16s | %20s | %7s | %7s | %7s |",
+			"Group/Server/Dir", "Snapshot", "Size in Mb", "Files", "Errors", "Minutes"),
 	}
 	totals.report += delimeter()
 
-	dateString := time.Now().Format("20060102")
-
+	// archives of this run, excluded from retention
+	created := make(map[string]bool)
+	// checksums of archives of this run, in 'sha256sum' format
+	manifest := ""
 	//
 	// enumerate servers
 	//
@@ -119,53 +162,201 @@ func dozip(group string) {
 			}
 			if !packtozip {
 				log.Printf("  WARN: skip dir '%s', packtozip = '%t'\n", dir, packtozip)
-				totals.report += fmt.Sprintf("%-25s | %20s | %7.2f |\n",
-					fmt.Sprintf("%s/%s/%s", group, server, dir), "SKIP", 0.0)
+				totals.report += fmt.Sprintf("%-25s | %16s | %20s | %7s | %7s | %7.2f |\n",
+					fmt.Sprintf("%s/%s/%s", group, server, dir), "-", "SKIP", "-", "-", 0.0)
+				continue
+			}
+			format := archiveFormat(keyOfDirs+"."+dir, "groups."+group)
+			if _, ok := archiveExts[format]; !ok {
+				msg := fmt.Sprintf("  WARN: skip dir '%s', unknown archiveformat '%s'\n", dir, format)
+				logTotals(&totals, msg)
 				continue
 			}
-			zipFileName := filepath.Join(viper.GetString("ZipPath"), strings.Join([]string{group, server, dir, dateString}, "_")+".zip")
-			zipArgsString := fmt.Sprintf("-r --exclude=*.zfs* -lf %s %s %s",
-				filepath.Join(viper.GetString("LogPath"), strings.Join([]string{"zip", group, server, dir}, "-")+".log"),
-				zipFileName,
-				dirBackupPath)
-			log.Printf("\tzip dir '%s' with par: %s\n", dir, zipArgsString)
-			zipArgs := strings.Fields(zipArgsString)
+			if tool := archiveTools[format]; tool != "" {
+				if _, err := exec.LookPath(tool); err != nil {
+					msg := fmt.Sprintf("  WARN: skip dir '%s', archiveformat '%s' needs '%s': %s\n",
+						dir, format, tool, err)
+					logTotals(&totals, msg)
+					continue
+				}
+			}
+			// archive from snapshot: latest managed or '-snapshot'
+			zPath := path.Join(viper.GetString("ZfsPath"), group, server, dir)
+			ds, err := zfs.GetDataset(zPath)
+			if err != nil {
+				msg := fmt.Sprintf("  WARN: skip dir '%s', error: '%s'\n", dir, err)
+				logTotals(&totals, msg)
+				continue
+			}
+			snaps, err := managedSnapshots(zPath)
+			if err != nil {
+				msg := fmt.Sprintf("  WARN: skip dir '%s', error: '%s'\n", dir, err)
+				logTotals(&totals, msg)
+				continue
+			}
+			snap, err := resolveSnapshot(snaps, snapshot)
+			if err != nil {
+				msg := fmt.Sprintf("  WARN: skip dir '%s', snapshot '%s': %s\n", dir, snapshot, err)
+				logTotals(&totals, msg)
+				continue
+			}
+			snapPath := filepath.Join(ds.Mountpoint, ".zfs", "snapshot", snap.snap)
+			// incremental archive: changed files since the last archive of chain
+			prefix := strings.Join([]string{group, server, dir}, "_") + "_"
+			var include func(string, os.FileInfo) bool
+			entry := chainEntry{Snapshot: snap.snap, SnapCreation: snap.creation, Mode: "full"}
+			chain, err := readChain(chainFileName(zipPath, prefix))
+			if err != nil {
+				msg := fmt.Sprintf("  WARN: dir '%s', chain manifest: %s, full archive\n", dir, err)
+				logTotals(&totals, msg)
+			} else if mode := viper.GetString(keyOfDirs + "." + dir + ".incremental"); mode != "" {
+				maxChain := defaultIncrementalChain
+				if viper.IsSet(keyOfDirs + "." + dir + ".incrementalchain") {
+					maxChain = viper.GetInt(keyOfDirs + "." + dir + ".incrementalchain")
+				}
+				var warn string
+				entry, include, warn = incrementalFilter(mode, chain, zipPath, zPath, ds.Mountpoint, snapPath,
+					snap, snaps, maxChain)
+				if warn != "" {
+					msg := fmt.Sprintf("  WARN: dir '%s', %s\n", dir, warn)
+					logTotals(&totals, msg)
+				}
+			}
+			// check free space of ZipPath for estimated size of archive:
+			// referenced size of snapshot, written since base for incremental archive
+			size, sizeOf := snap.referenced, "referenced"
+			if include != nil {
+				prop := "written@" + entry.Base
+				if props, err := zfsGetProps(snap.name, prop); err == nil {
+					size, sizeOf = propUint(props, prop), prop
+				}
+			}
+			need, ratio := zipEstimate(group, server, dir, size, snaps)
+			props, err := zfsGetProps(zipPath, "available")
+			if err != nil {
+				msg := fmt.Sprintf("  WARN: free space of '%s' not checked: %s\n", zipPath, err)
+				logTotals(&totals, msg)
+			} else if free := propUint(props, "available"); need > free {
+				msg := fmt.Sprintf("  WARN: skip dir '%s', need ~%s Mb (%s %s Mb x %.2f), free %s Mb in '%s'\n",
+					dir, sizeMb(need), sizeOf, sizeMb(size), ratio, sizeMb(free), zipPath)
+				logTotals(&totals, msg)
+				totals.report += fmt.Sprintf("%-25s | %16s | %20s | %7s | %7s | %7.2f |\n",
+					fmt.Sprintf("%s/%s/%s", group, server, dir), snap.snap, "NO SPACE", "-", "-", 0.0)
+				continue
+			}
+			suffix := ""
+			if include != nil {
+				suffix = "-inc"
+			}
+			zipName, err := zipBaseName(zipNameData{Group: group, Server: server, Dir: dir, Host: hostname,
+				Snapshot: snap.snap, Label: snap.label, Date: snap.creation})
+			if err == nil {
+				// archives of dir are found by prefix for retention and verify
+				_, err = zipPrefix(group, server, dir)
+			}
+			if err != nil {
+				msg := fmt.Sprintf("  WARN: skip dir '%s', archivename: %s\n", dir, err)
+				logTotals(&totals, msg)
+				continue
+			}
+			zipFileName := filepath.Join(viper.GetString("ZipPath"), zipName+suffix+archiveExts[format])
+			// encrypt for public keys of group
+			recipients := viper.GetStringSlice("groups." + group + ".archiverecipients")
+			if len(recipients) > 0 {
+				zipFileName += ".gpg"
+			}
+			zipLogFileName := filepath.Join(viper.GetString("LogPath"),
+				strings.Join([]string{"zip", group, server, dir}, "-")+".log")
+			excludes, warns := zipExcludes(keyOfDirs+"."+dir, "groups."+group)
+			for _, warn := range warns {
+				msg := fmt.Sprintf("  WARN: dir '%s', %s\n", dir, warn)
+				logTotals(&totals, msg)
+			}
+			// split to volumes of 'volumesize' Mb, default 0 - single file
+			volumeSize := viper.GetInt64(keyOfDirs + "." + dir + ".volumesize")
+			if include != nil {
+				log.Printf("\tincremental (%s) since '%s'\n", entry.Mode, entry.Base)
+			}
+			log.Printf("\t%s dir '%s' from '%s' to '%s'\n", format, dir, snap.name, zipFileName)
 			// execute zip
 			timeStart := time.Now()
 			totals.zipTotalTask++
-			cmd := exec.Command("zip", zipArgs...)
-			outputs, err := cmd.CombinedOutput()
+			stats, err := archiveDir(format, snapPath, dirBackupPath, zipFileName, zipLogFileName,
+				excludes, recipients, volumeSize*1024*1024, include)
 			if err != nil {
 				totals.zipErrorTask++
-				totals.zipErrMsg += fmt.Sprintf("  %s: %s\n%s\n\n",
-					strings.Join([]string{group, server, dir}, "-"),
-					err.Error(), string(outputs))
-				log.Println("\t\tzip output:\n" + string(outputs))
+				totals.zipErrMsg += fmt.Sprintf("  %s: %s\n\n",
+					strings.Join([]string{group, server, dir}, "-"), err.Error())
+				log.Printf("\t\tzip error: %s\n", err)
+				// partial archive must not replace the last good one in retention
+				removePartialArchive(zipFileName)
+			}
+			for _, e := range stats.errors {
+				totals.fileErrNum++
+				totals.fileErrMsg += fmt.Sprintf("  %s: %s\n",
+					strings.Join([]string{group, server, dir}, "-"), e)
+				log.Printf("\t\tfile error: %s\n", e)
 			}
 			timeStop := time.Now()
+			// chain manifest: new chain from full archive
+			if err == nil {
+				entry.Name = filepath.Base(zipFileName)
+				if include == nil {
+					chain = zipChain{Dir: fmt.Sprintf("%s/%s/%s", group, server, dir)}
+				}
+				chain.Archives = append(chain.Archives, entry)
+				if err := writeChain(chainFileName(zipPath, prefix), chain); err != nil {
+					msg := fmt.Sprintf("  WARN: dir '%s', chain manifest: %s\n", dir, err)
+					logTotals(&totals, msg)
+				}
+			}
 
-			fsize := "err"
-			fstat, err := os.Stat(zipFileName)
-			if err != nil {
-				msg := fmt.Sprintf("  WARN: error stat '%s'\n", zipFileName)
-				logTotals(&totals, msg)
-			} else {
-				fsize = humanize.Commaf(float64(fstat.Size()) / 1024 / 1024)
+			if err == nil {
+				created[filepath.Base(zipFileName)] = true
+			}
+			if err == nil && stats.sha256 != "" {
+				manifest += stats.sha256 + "  " + filepath.Base(zipFileName) + "\n"
 			}
-			totals.report += fmt.Sprintf("%-25s | %20s | %7.2f |\n",
-				fmt.Sprintf("%s/%s/%s", group, server, dir),
-				fsize[:(strings.Index(fsize, ".")+2)],
+			fsize := sizeMb(uint64(stats.size))
+			if stats.parts > 0 {
+				fsize = fmt.Sprintf("%d x %s", stats.parts, fsize)
+				log.Printf("\t\t%d volumes, manifest '%s.parts'\n", stats.parts, zipFileName)
+			}
+			totals.report += fmt.Sprintf("%-25s | %16s | %20s | %7d | %7d | %7.2f |\n",
+				fmt.Sprintf("%s/%s/%s", group, server, dir), snap.snap,
+				fsize, stats.files, len(stats.errors),
 				timeStop.Sub(timeStart).Minutes())
 		}
 	}
 
+	// write manifest of run
+	if manifest != "" {
+		manifestFileName := filepath.Join(zipPath,
+			"zip-manifest_"+group+"_"+time.Now().Format("20060102-1504")+".sha256")
+		if err := ioutil.WriteFile(manifestFileName, []byte(manifest), 0644); err != nil {
+			msg := fmt.Sprintf("  WARN: write manifest '%s': %s\n", manifestFileName, err)
+			totals.warnNum++
+			totals.warnMsg += msg
+			log.Printf(msg)
+		}
+	}
+
+	//
+	// retention of archives in ZipPath
+	//
+	for _, msg := range zipRetention(group, created) {
+		totals.deletedMsg += msg
+		log.Printf(msg)
+	}
+
 	//
 	// make report
 	//
 	subj := fmt.Sprintf("zync'n'znap zip %s/%s: err/warn/total = %d/%d/%d",
 		strings.ToUpper(hostname), strings.ToUpper(group),
-		totals.zipErrorTask, totals.warnNum, totals.zipTotalTask)
-	msg := totals.report + delimeter() + totals.zipErrMsg + delimeter() + totals.warnMsg
+		totals.zipErrorTask, totals.warnNum+totals.fileErrNum, totals.zipTotalTask)
+	msg := totals.report + delimeter() + totals.zipErrMsg + delimeter() + totals.warnMsg +
+		delimeter() + totals.fileErrMsg + delimeter() + totals.deletedMsg
 	// write report to logpath
 	err := ioutil.WriteFile(
 		filepath.Join(viper.GetString("LogPath"), "zip-report"+group+".log"),
@@ -179,3 +370,375 @@ func dozip(group string) {
 	}
 
 }
+
+// archiveFormat returns 'archiveformat' of dir or group, default "zip"
+func archiveFormat(keyOfDir, keyOfGroup string) string {
+	if viper.IsSet(keyOfDir + ".archiveformat") {
+		return viper.GetString(keyOfDir + ".archiveformat")
+	}
+	if viper.IsSet(keyOfGroup + ".archiveformat") {
+		return viper.GetString(keyOfGroup + ".archiveformat")
+	}
+	return "zip"
+}
+
+// zipEstimate returns estimated size of archive of dir with 'size' of data:
+// 'size' x the largest ratio of size of previous full archive of dir
+// to referenced size of its snapshot, 1.0 without history
+func zipEstimate(group, server, dir string, size uint64, snaps []managedSnap) (uint64, float64) {
+	ratio := 0.0
+	prefix, _ := zipPrefix(group, server, dir)
+	archives, _ := zipDirArchives(viper.GetString("ZipPath"))
+	for _, a := range archives {
+		// without incremental archives
+		if a.prefix != prefix || a.inc {
+			continue
+		}
+		for _, s := range snaps {
+			if s.snap == a.snap && s.referenced > 0 {
+				if r := float64(a.size) / float64(s.referenced); r > ratio {
+					ratio = r
+				}
+			}
+		}
+	}
+	if ratio == 0 {
+		ratio = 1.0
+	}
+	return uint64(float64(size) * ratio), ratio
+}
+
+// zipRetention deletes archives in ZipPath: more than 'zipretention.keep'
+// or older than 'zipretention.maxage' days for dirs of group (the newest
+// archive of dir and archives of incremental chains are kept), then the oldest
+// archives of all groups while total size more than 'zipretention.maxsize' Gb.
+// Returns report lines.
+func zipRetention(group string, created map[string]bool) []string {
+	var msgs []string
+	keep := viper.GetInt("zipretention.keep")
+	maxAge := viper.GetInt("zipretention.maxage")
+	maxSize := int64(viper.GetFloat64("zipretention.maxsize") * 1024 * 1024 * 1024)
+	if keep <= 0 && maxAge <= 0 && maxSize <= 0 {
+		return msgs
+	}
+	archives, err := zipDirArchives(viper.GetString("ZipPath"))
+	if err != nil {
+		return append(msgs, fmt.Sprintf("  WARN: retention: %s\n", err))
+	}
+	// the newest first, by date and name
+	sort.Slice(archives, func(i, j int) bool {
+		if !archives[i].date.Equal(archives[j].date) {
+			return archives[i].date.After(archives[j].date)
+		}
+		return archives[i].name > archives[j].name
+	})
+	// archives of this run and of chains of incremental archives are kept
+	protected := make(map[string]bool)
+	for name := range created {
+		protected[name] = true
+	}
+	chains, _ := filepath.Glob(chainFileName(viper.GetString("ZipPath"), "*_"))
+	for _, c := range chains {
+		if chain, err := readChain(c); err == nil {
+			for _, a := range chain.Archives {
+				protected[a.Name] = true
+			}
+		}
+	}
+	var prefixes []string
+	for server := range viper.GetStringMap("groups." + group + ".servers") {
+		for dir := range viper.GetStringMap("groups." + group + ".servers." + server + ".dirs") {
+			if prefix, err := zipPrefix(group, server, dir); err == nil {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	deletes, total := retentionDeletes(archives, prefixes, protected, keep, maxAge, maxSize, time.Now())
+	for _, d := range deletes {
+		a := d.archive
+		fileName := filepath.Join(viper.GetString("ZipPath"), a.name)
+		if a.volumes != nil {
+			for _, v := range a.volumes {
+				os.Remove(v)
+			}
+			fileName += ".parts"
+		}
+		if err := os.Remove(fileName); err != nil {
+			msgs = append(msgs, fmt.Sprintf("  WARN: delete '%s': %s\n", a.name, err))
+			total += a.size
+			continue
+		}
+		os.Remove(filepath.Join(viper.GetString("ZipPath"), a.name+".sha256"))
+		msgs = append(msgs, fmt.Sprintf("  deleted '%s', %s Mb, %s\n", a.name, sizeMb(uint64(a.size)), d.reason))
+	}
+	if maxSize > 0 && total > maxSize {
+		msgs = append(msgs, fmt.Sprintf("  WARN: archives %s Mb, more than 'zipretention.maxsize'\n",
+			sizeMb(uint64(total))))
+	}
+	// manifests of runs without archives
+	manifests, _ := filepath.Glob(filepath.Join(viper.GetString("ZipPath"), "zip-manifest_"+group+"_*.sha256"))
+	for _, m := range manifests {
+		sums, err := readChecksums(m)
+		if err != nil {
+			continue
+		}
+		exist := false
+		for name := range sums {
+			exist = exist || zipArchiveExist(viper.GetString("ZipPath"), name)
+		}
+		if !exist {
+			if err := os.Remove(m); err != nil {
+				msgs = append(msgs, fmt.Sprintf("  WARN: delete '%s': %s\n", filepath.Base(m), err))
+				continue
+			}
+			msgs = append(msgs, fmt.Sprintf("  deleted '%s', all archives deleted\n", filepath.Base(m)))
+		}
+	}
+	return msgs
+}
+
+// removePartialArchive removes archive 'fileName' of failed run
+// with volumes, manifest of volumes and checksum file
+func removePartialArchive(fileName string) {
+	volumes, _ := filepath.Glob(fileName + ".[0-9][0-9][0-9]*")
+	for _, f := range append(volumes, fileName, fileName+".parts", fileName+".sha256") {
+		os.Remove(f)
+	}
+}
+
+// retentionDelete - archive selected for deletion by retention
+type retentionDelete struct {
+	archive zipArchive
+	reason  string
+}
+
+// retentionDeletes selects archives for deletion, 'archives' are sorted the newest first:
+// more than 'keep' or older than 'maxAge' days for dirs 'prefixes', then the oldest of
+// all archives while total size more than 'maxSize'. The newest complete archive (with
+// checksum file) of each dir and archives in 'kept' are never selected. Returns total size of remaining archives.
+func retentionDeletes(archives []zipArchive, prefixes []string, kept map[string]bool,
+	keep, maxAge int, maxSize int64, now time.Time) ([]retentionDelete, int64) {
+	var deletes []retentionDelete
+	deleted := make(map[string]bool)
+	remove := func(a zipArchive, reason string) {
+		deleted[a.name] = true
+		deletes = append(deletes, retentionDelete{archive: a, reason: reason})
+	}
+	newest := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, a := range archives {
+		if a.sidecar && !seen[a.prefix] {
+			seen[a.prefix] = true
+			newest[a.name] = true
+		}
+	}
+	// keep / maxage by dirs of group
+	for _, prefix := range prefixes {
+		n := 0
+		for _, a := range archives {
+			if a.prefix != prefix {
+				continue
+			}
+			n++
+			switch {
+			case newest[a.name] || kept[a.name]:
+			case keep > 0 && n > keep:
+				remove(a, fmt.Sprintf("keep = %d", keep))
+			case maxAge > 0 && now.Sub(a.date) > time.Hour*24*time.Duration(maxAge):
+				remove(a, fmt.Sprintf("maxage = %d days", maxAge))
+			}
+		}
+	}
+	// maxsize for all archives
+	var total int64
+	for _, a := range archives {
+		if !deleted[a.name] {
+			total += a.size
+		}
+	}
+	if maxSize <= 0 {
+		return deletes, total
+	}
+	for i := len(archives) - 1; i >= 0 && total > maxSize; i-- {
+		a := archives[i]
+		if deleted[a.name] || kept[a.name] || newest[a.name] {
+			continue
+		}
+		remove(a, fmt.Sprintf("maxsize = %g Gb", float64(maxSize)/1024/1024/1024))
+		total -= a.size
+	}
+	return deletes, total
+}
+
+// zipArchives returns archive files in 'zipPath', size of split archive is sum of volumes
+func zipArchives(zipPath string) ([]zipArchive, error) {
+	entries, err := ioutil.ReadDir(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	var archives []zipArchive
+	for _, e := range entries {
+		m := zipArchiveRe.FindStringSubmatch(e.Name())
+		if m == nil || !e.Mode().IsRegular() {
+			continue
+		}
+		a := zipArchive{name: e.Name(), size: e.Size()}
+		if m[3] != "" {
+			a.name = strings.TrimSuffix(a.name, ".parts")
+			a.size = 0
+			a.volumes, _, err = archiveVolumes(filepath.Join(zipPath, e.Name()))
+			if err != nil || len(a.volumes) == 0 {
+				continue
+			}
+			for _, v := range a.volumes {
+				if fstat, err := os.Stat(v); err == nil {
+					a.size += fstat.Size()
+				}
+			}
+		}
+		if _, err := os.Stat(filepath.Join(zipPath, a.name+".sha256")); err == nil {
+			a.sidecar = true
+		}
+		archives = append(archives, a)
+	}
+	return archives, nil
+}
+
+// zipDirArchives returns archives in 'zipPath' of dirs of all groups
+// with prefix, snapshot and date of snapshot from name
+func zipDirArchives(zipPath string) ([]zipArchive, error) {
+	all, err := zipArchives(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	// colliding prefixes of dirs are rejected by zipPrefix, their archives are skipped
+	dirsOfPrefix := make(map[string]int)
+	for _, prefix := range zipPrefixes() {
+		dirsOfPrefix[prefix]++
+	}
+	var prefixes []string
+	for prefix, n := range dirsOfPrefix {
+		if prefix != "" && n == 1 {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	var archives []zipArchive
+	for _, a := range all {
+		// archive of one dir only, the longest prefix: 'g_s_dir_' and 'g_s_dir_2_'
+		a.prefix = ""
+		for _, prefix := range prefixes {
+			if len(prefix) <= len(a.prefix) || !strings.HasPrefix(a.name, prefix) {
+				continue
+			}
+			m := zipSnapRe.FindStringSubmatch(strings.TrimPrefix(a.name, prefix))
+			if m == nil {
+				continue
+			}
+			date, err := time.ParseInLocation("20060102", m[1][:8], time.Local)
+			if err != nil {
+				continue
+			}
+			a.prefix, a.snap, a.date = prefix, m[1], date
+		}
+		if a.prefix == "" {
+			continue
+		}
+		// name without extension ends with '-inc'
+		a.inc = strings.HasSuffix(a.name[:zipArchiveRe.FindStringIndex(a.name)[0]], "-inc")
+		archives = append(archives, a)
+	}
+	return archives, nil
+}
+
+// zipPrefixes returns prefixes of names of archives by dirs 'group/server/dir'
+// of all groups, empty for invalid 'archivename'
+func zipPrefixes() map[string]string {
+	prefixes := make(map[string]string)
+	for group := range viper.GetStringMap("groups") {
+		for server := range viper.GetStringMap("groups." + group + ".servers") {
+			for dir := range viper.GetStringMap("groups." + group + ".servers." + server + ".dirs") {
+				prefix, _ := dirZipPrefix(group, server, dir)
+				prefixes[strings.Join([]string{group, server, dir}, "/")] = prefix
+			}
+		}
+	}
+	return prefixes
+}
+
+// zipBaseName returns name of archive without extension by template 'archivename'
+// of dir or group, default 'group_server_dir_snapshot'
+func zipBaseName(data zipNameData) (string, error) {
+	keyOfGroup := "groups." + data.Group
+	keyOfDir := keyOfGroup + ".servers." + data.Server + ".dirs." + data.Dir
+	text := defaultZipName
+	if viper.IsSet(keyOfDir + ".archivename") {
+		text = viper.GetString(keyOfDir + ".archivename")
+	} else if viper.IsSet(keyOfGroup + ".archivename") {
+		text = viper.GetString(keyOfGroup + ".archivename")
+	}
+	tmpl, err := template.New("archivename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var name bytes.Buffer
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", err
+	}
+	if name.Len() == 0 || strings.Contains(name.String(), "/") {
+		return "", fmt.Errorf("wrong name '%s'", name.String())
+	}
+	return name.String(), nil
+}
+
+// zipPrefix returns part of names of archives of dir before snapshot.
+// Template must contain '{{.Snapshot}}', fields before it must not depend on snapshot.
+// Prefix must differ from prefixes of other dirs, archives are found by it.
+func zipPrefix(group, server, dir string) (string, error) {
+	prefix, err := dirZipPrefix(group, server, dir)
+	if err != nil {
+		return "", err
+	}
+	self := strings.Join([]string{group, server, dir}, "/")
+	for other, p := range zipPrefixes() {
+		if other != self && p == prefix {
+			return "", fmt.Errorf("prefix '%s' same as of dir '%s'", prefix, other)
+		}
+	}
+	return prefix, nil
+}
+
+func dirZipPrefix(group, server, dir string) (string, error) {
+	const marker = "\x00"
+	data := zipNameData{Group: group, Server: server, Dir: dir, Host: getHostName(),
+		Snapshot: marker, Label: "d", Date: time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)}
+	name, err := zipBaseName(data)
+	if err != nil {
+		return "", err
+	}
+	i := strings.Index(name, marker)
+	if i < 0 {
+		return "", fmt.Errorf("template without '{{.Snapshot}}'")
+	}
+	data.Label, data.Date = "h", time.Date(2001, 2, 3, 4, 5, 0, 0, time.Local)
+	if other, err := zipBaseName(data); err != nil || strings.Index(other, marker) != i ||
+		other[:i] != name[:i] {
+		return "", fmt.Errorf("fields before '{{.Snapshot}}' depend on snapshot")
+	}
+	return name[:i], nil
+}
+
+// zipExcludes returns default exclude patterns and 'excludes' of group and dir,
+// invalid patterns are skipped and returned as warnings
+func zipExcludes(keyOfDir, keyOfGroup string) ([]string, []string) {
+	excludes := append([]string{}, defaultExcludes...)
+	var warns []string
+	patterns := append(viper.GetStringSlice(keyOfGroup+".excludes"), viper.GetStringSlice(keyOfDir+".excludes")...)
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			warns = append(warns, fmt.Sprintf("exclude pattern '%s': %s, skipped", pattern, err))
+			continue
+		}
+		excludes = append(excludes, pattern)
+	}
+	return excludes, warns
+}
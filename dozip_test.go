@@ -0,0 +1,237 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const testZipConfig = `
+[groups.g1]
+archivename = "{{.Group}}-{{.Dir}}-{{.Snapshot}}"
+[groups.g1.servers.s.dirs.d]
+[groups.g1.servers.s.dirs.d2]
+[groups.g1.servers.s.dirs.www]
+archivename = "{{.Server}}_{{.Dir}}_{{.Date.Format \"2006\"}}_{{.Snapshot}}"
+excludes = ["*.log", "[bad"]
+[groups.g1.servers.s.dirs.bydate]
+archivename = "{{.Dir}}_{{.Date.Format \"20060102\"}}_{{.Snapshot}}"
+[groups.g1.servers.s.dirs.nosnap]
+archivename = "{{.Dir}}"
+[groups.g2]
+archivename = "{{.Dir}}_{{.Snapshot}}"
+excludes = ["cache"]
+[groups.g2.servers.s1.dirs.data]
+[groups.g2.servers.s2.dirs.data]
+[groups.g3.servers.s.dirs.d]
+`
+
+func TestZipSnapRe(t *testing.T) {
+	tests := []struct {
+		rest string
+		want string
+	}{
+		{"20261019d.zip", "20261019d"},
+		{"20261019w-inc.tar.zst.gpg", "20261019w"},
+		{"20261019-1530h.tar.gz", "20261019-1530h"},
+		{"2_20261019d.zip", ""},
+		{"20261019.zip", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if m := zipSnapRe.FindStringSubmatch(tt.rest); m != nil {
+			got = m[1]
+		}
+		if got != tt.want {
+			t.Errorf("zipSnapRe(%q) = %q, want %q", tt.rest, got, tt.want)
+		}
+	}
+}
+
+func TestZipBaseName(t *testing.T) {
+	readTestConfig(t, testZipConfig)
+	at := time.Date(2026, 10, 19, 1, 0, 0, 0, time.Local)
+	tests := []struct {
+		group, server, dir string
+		want               string
+		wantErr            bool
+	}{
+		{"g3", "s", "d", "g3_s_d_20261019d", false},
+		{"g1", "s", "d", "g1-d-20261019d", false},
+		{"g1", "s", "www", "s_www_2026_20261019d", false},
+		{"g1", "s", "bydate", "bydate_20261019_20261019d", false},
+		{"g2", "s1", "data", "data_20261019d", false},
+	}
+	for _, tt := range tests {
+		got, err := zipBaseName(zipNameData{Group: tt.group, Server: tt.server, Dir: tt.dir,
+			Host: "host", Snapshot: "20261019d", Label: "d", Date: at})
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("zipBaseName(%s/%s/%s) = %q, %v, want %q", tt.group, tt.server, tt.dir, got, err, tt.want)
+		}
+	}
+	for _, text := range []string{"{{.Group}", "{{.Unknown}}", "{{.Group}}/{{.Snapshot}}", ""} {
+		viper.Set("groups.g3.servers.s.dirs.d.archivename", text)
+		if got, err := zipBaseName(zipNameData{Group: "g3", Server: "s", Dir: "d", Snapshot: "20261019d"}); err == nil {
+			t.Errorf("zipBaseName with archivename %q = %q, want error", text, got)
+		}
+	}
+}
+
+func TestZipPrefix(t *testing.T) {
+	readTestConfig(t, testZipConfig)
+	tests := []struct {
+		group, server, dir string
+		want               string
+		wantErr            bool
+	}{
+		{"g3", "s", "d", "g3_s_d_", false},
+		{"g1", "s", "d", "g1-d-", false},
+		{"g1", "s", "d2", "g1-d2-", false},
+		{"g1", "s", "www", "", true},    // year of snapshot before '{{.Snapshot}}'
+		{"g1", "s", "bydate", "", true}, // date of snapshot before '{{.Snapshot}}'
+		{"g1", "s", "nosnap", "", true}, // without '{{.Snapshot}}'
+		{"g2", "s1", "data", "", true},  // same prefix as 'g2/s2/data'
+		{"g2", "s2", "data", "", true},
+	}
+	for _, tt := range tests {
+		got, err := zipPrefix(tt.group, tt.server, tt.dir)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("zipPrefix(%s/%s/%s) = %q, %v, want %q, error %t",
+				tt.group, tt.server, tt.dir, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestZipExcludes(t *testing.T) {
+	readTestConfig(t, testZipConfig)
+	tests := []struct {
+		keyOfDir, keyOfGroup string
+		want                 []string
+		warns                int
+	}{
+		{"groups.g1.servers.s.dirs.www", "groups.g1", []string{"*.zfs*", "*.log"}, 1},
+		{"groups.g2.servers.s1.dirs.data", "groups.g2", []string{"*.zfs*", "cache"}, 0},
+		{"groups.g3.servers.s.dirs.d", "groups.g3", []string{"*.zfs*"}, 0},
+	}
+	for _, tt := range tests {
+		got, warns := zipExcludes(tt.keyOfDir, tt.keyOfGroup)
+		if !reflect.DeepEqual(got, tt.want) || len(warns) != tt.warns {
+			t.Errorf("zipExcludes(%s) = %q, %q, want %q and %d warnings", tt.keyOfDir, got, warns, tt.want, tt.warns)
+		}
+	}
+}
+
+func TestZipDirArchives(t *testing.T) {
+	readTestConfig(t, testZipConfig)
+	zipPath := t.TempDir()
+	files := []string{
+		"g1-d-20261018d.zip",
+		"g1-d-20261019d-inc.zip",
+		"g1-d2-20261019d.tar.zst.gpg",
+		"g3_s_d_20261019-1200h.tar.gz",
+		"g3_s_d_20261019d.zip.sha256", // sidecar
+		"data_20261019d.zip",          // colliding prefixes of 'g2'
+		"g1-d-manual.zip",             // not managed snapshot
+		"zip-manifest_g1_20261019-0100.sha256",
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(zipPath, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archives, err := zipDirArchives(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].name < archives[j].name })
+	type result struct {
+		name, prefix, snap string
+		inc                bool
+	}
+	var got []result
+	for _, a := range archives {
+		got = append(got, result{a.name, a.prefix, a.snap, a.inc})
+	}
+	want := []result{
+		{"g1-d-20261018d.zip", "g1-d-", "20261018d", false},
+		{"g1-d-20261019d-inc.zip", "g1-d-", "20261019d", true},
+		{"g1-d2-20261019d.tar.zst.gpg", "g1-d2-", "20261019d", false},
+		{"g3_s_d_20261019-1200h.tar.gz", "g3_s_d_", "20261019-1200h", false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("zipDirArchives() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRetentionDeletes(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	archive := func(prefix string, daysAgo int, size int64) zipArchive {
+		date := now.AddDate(0, 0, -daysAgo)
+		snap := date.Format("20060102") + "d"
+		return zipArchive{name: prefix + snap + ".zip", prefix: prefix, snap: snap, date: date, size: size,
+			sidecar: true}
+	}
+	const gb = 1024 * 1024 * 1024
+	// the newest first
+	archives := []zipArchive{
+		archive("g_s_a_", 0, gb),
+		archive("g_s_a_", 1, gb),
+		archive("g_s_b_", 1, gb),
+		archive("g_s_a_", 2, gb),
+		archive("g_s_a_", 10, gb),
+		archive("g_s_b_", 20, gb),
+	}
+	prefixes := []string{"g_s_a_", "g_s_b_"}
+	tests := []struct {
+		name    string
+		kept    map[string]bool
+		keep    int
+		maxAge  int
+		maxSize int64
+		want    []string
+		total   int64
+	}{
+		{"no limits", nil, 0, 0, 0, nil, 6 * gb},
+		{"keep", nil, 2, 0, 0,
+			[]string{"g_s_a_20261017d.zip", "g_s_a_20261009d.zip"}, 4 * gb},
+		{"maxage", nil, 0, 5, 0,
+			[]string{"g_s_a_20261009d.zip", "g_s_b_20260929d.zip"}, 4 * gb},
+		{"maxsize, the oldest first", nil, 0, 0, 4 * gb,
+			[]string{"g_s_b_20260929d.zip", "g_s_a_20261009d.zip"}, 4 * gb},
+		{"maxsize keeps the newest of dir", nil, 0, 0, gb,
+			[]string{"g_s_b_20260929d.zip", "g_s_a_20261009d.zip", "g_s_a_20261017d.zip", "g_s_a_20261018d.zip"},
+			2 * gb},
+		{"kept archives", map[string]bool{"g_s_a_20261009d.zip": true}, 1, 0, 0,
+			[]string{"g_s_a_20261018d.zip", "g_s_a_20261017d.zip", "g_s_b_20260929d.zip"}, 3 * gb},
+		{"keep and maxsize", nil, 3, 0, 3 * gb,
+			[]string{"g_s_a_20261009d.zip", "g_s_b_20260929d.zip", "g_s_a_20261017d.zip"}, 3 * gb},
+	}
+	for _, tt := range tests {
+		deletes, total := retentionDeletes(archives, prefixes, tt.kept, tt.keep, tt.maxAge, tt.maxSize, now)
+		var got []string
+		for _, d := range deletes {
+			got = append(got, d.archive.name)
+		}
+		if !reflect.DeepEqual(got, tt.want) || total != tt.total {
+			t.Errorf("%s: retentionDeletes() = %q, total %d, want %q, total %d",
+				tt.name, got, total, tt.want, tt.total)
+		}
+	}
+	// archive of failed run without checksum file is not the newest of dir
+	archives[0].sidecar = false
+	deletes, total := retentionDeletes(archives, prefixes, nil, 1, 0, 0, now)
+	var got []string
+	for _, d := range deletes {
+		got = append(got, d.archive.name)
+	}
+	want := []string{"g_s_a_20261017d.zip", "g_s_a_20261009d.zip", "g_s_b_20260929d.zip"}
+	if !reflect.DeepEqual(got, want) || total != 3*gb {
+		t.Errorf("without checksum file: retentionDeletes() = %q, total %d, want %q, total %d",
+			got, total, want, 3*gb)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// listXattrs returns extended attributes of file
+func listXattrs(p string) (map[string]string, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err != nil || size == 0 {
+		// filesystems without xattr
+		return nil, nil
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(p, names); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vsize, err := syscall.Getxattr(p, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = syscall.Getxattr(p, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value[:vsize])
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// listXattrs returns extended attributes of file, not supported on this OS
+func listXattrs(p string) (map[string]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zipChain - chain manifest of dir 'group_server_dir_chain.json' in ZipPath:
+// the full archive and incremental archives to apply in order on restore
+type zipChain struct {
+	Dir      string       `json:"dir"`
+	Archives []chainEntry `json:"archives"`
+}
+
+type chainEntry struct {
+	Name         string    `json:"name"`
+	Snapshot     string    `json:"snapshot"`
+	SnapCreation time.Time `json:"snapcreation"`
+	Mode         string    `json:"mode"`              // full | zfsdiff | mtime
+	Base         string    `json:"base,omitempty"`    // snapshot of previous archive in chain
+	Deleted      []string  `json:"deleted,omitempty"` // paths removed since base, delete on restore
+	Note         string    `json:"note,omitempty"`
+}
+
+// note of incremental archive by mtime: 'zfs diff' is not available
+const mtimeNote = "mode mtime: deleted files are not recorded, " +
+	"restore of chain brings back files deleted since base"
+
+// default max number of incremental archives after full
+const defaultIncrementalChain = 6
+
+// escaped chars in output of 'zfs diff': '\0040' - space
+var zfsDiffEscRe = regexp.MustCompile(`\\0([0-7]{3})`)
+
+// chainFileName returns path of chain manifest of dir 'prefix' ('group_server_dir_')
+func chainFileName(zipPath, prefix string) string {
+	return filepath.Join(zipPath, prefix+"chain.json")
+}
+
+// readChain reads chain manifest, empty chain if not exist
+func readChain(fileName string) (zipChain, error) {
+	var chain zipChain
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return chain, nil
+	}
+	if err != nil {
+		return chain, err
+	}
+	return chain, json.Unmarshal(data, &chain)
+}
+
+// zipArchiveExist checks archive file or manifest of volumes in 'zipPath'
+func zipArchiveExist(zipPath, name string) bool {
+	if _, err := os.Stat(filepath.Join(zipPath, name)); err == nil {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(zipPath, name+".parts"))
+	return err == nil
+}
+
+func writeChain(fileName string, chain zipChain) error {
+	data, err := json.MarshalIndent(chain, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append(data, '\n'), 0644)
+}
+
+// incrementalFilter returns entry of chain for archive of snapshot 'snap' and
+// filter of changed files since the last archive of 'chain' in mode 'zfsdiff' or 'mtime'.
+// Full archive (nil filter) if chain is empty, broken or longer than 'maxChain'.
+// Mode 'zfsdiff' falls back to 'mtime' if base snapshot was deleted, warning is returned.
+// Mode 'mtime' selects files by mtime or ctime after base snapshot, does not record
+// deleted files, entry has a note about it.
+func incrementalFilter(mode string, chain zipChain, zipPath, zPath, mountpoint, snapPath string,
+	snap managedSnap, snaps []managedSnap, maxChain int) (chainEntry, func(string, os.FileInfo) bool, string) {
+	entry := chainEntry{Snapshot: snap.snap, SnapCreation: snap.creation, Mode: "full"}
+	if mode != "zfsdiff" && mode != "mtime" {
+		return entry, nil, fmt.Sprintf("unknown incremental mode '%s', full archive", mode)
+	}
+	if len(chain.Archives) == 0 || len(chain.Archives) > maxChain {
+		return entry, nil, ""
+	}
+	last := chain.Archives[len(chain.Archives)-1]
+	// all archives of chain must exist for restore
+	for _, a := range chain.Archives {
+		if !zipArchiveExist(zipPath, a.Name) {
+			return entry, nil, fmt.Sprintf("archive '%s' of chain not found, full archive", a.Name)
+		}
+	}
+	if last.Snapshot == snap.snap || !snap.creation.After(last.SnapCreation) {
+		return entry, nil, ""
+	}
+	entry.Base = last.Snapshot
+	warn := ""
+	if mode == "zfsdiff" {
+		baseExist := false
+		for _, s := range snaps {
+			baseExist = baseExist || s.snap == last.Snapshot
+		}
+		if baseExist {
+			changed, renamed, deleted, err := zfsDiff(zPath+"@"+last.Snapshot, zPath+"@"+snap.snap, mountpoint)
+			if err == nil {
+				entry.Mode = "zfsdiff"
+				entry.Deleted = deleted
+				return entry, func(p string, info os.FileInfo) bool {
+					rel, _ := filepath.Rel(snapPath, p)
+					if changed[rel] {
+						return true
+					}
+					for _, d := range renamed {
+						if strings.HasPrefix(rel, d+"/") {
+							return true
+						}
+					}
+					return false
+				}, ""
+			}
+			warn = fmt.Sprintf("zfs diff: %s, ", err)
+		} else {
+			warn = fmt.Sprintf("base snapshot '%s' not found, ", last.Snapshot)
+		}
+		warn += "incremental archive by mtime"
+	}
+	entry.Mode = "mtime"
+	entry.Note = mtimeNote
+	since := last.SnapCreation
+	return entry, func(p string, info os.FileInfo) bool {
+		// rsync keeps mtime of server, local ctime is time of sync of file
+		return !info.IsDir() && (info.ModTime().After(since) || fileCtime(info).After(since))
+	}, warn
+}
+
+// zfsDiff returns changed paths relative to 'mountpoint' between snapshots 'from' and 'to':
+// created, modified and renamed paths, renamed dirs (with all content) and deleted paths
+func zfsDiff(from, to, mountpoint string) (map[string]bool, []string, []string, error) {
+	cmd := exec.Command("zfs", "diff", "-FH", from, to)
+	outputs, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, nil, nil, fmt.Errorf("%s, %s", strings.TrimSpace(string(ee.Stderr)), err)
+		}
+		return nil, nil, nil, err
+	}
+	changed, renamed, deleted := parseZfsDiff(string(outputs), mountpoint)
+	return changed, renamed, deleted, nil
+}
+
+// parseZfsDiff parses output of 'zfs diff -FH', paths are unescaped and relative to 'mountpoint'
+func parseZfsDiff(outputs, mountpoint string) (map[string]bool, []string, []string) {
+	rel := func(p string) string {
+		p = zfsDiffEscRe.ReplaceAllStringFunc(p, func(s string) string {
+			c, _ := strconv.ParseUint(s[2:], 8, 8)
+			return string([]byte{byte(c)})
+		})
+		return strings.TrimPrefix(strings.TrimPrefix(p, mountpoint), "/")
+	}
+	changed := make(map[string]bool)
+	var renamed, deleted []string
+	for _, s := range strings.Split(outputs, "\n") {
+		// 'change<TAB>type<TAB>path[<TAB>new path]'
+		f := strings.Split(s, "\t")
+		if len(f) < 3 {
+			continue
+		}
+		switch f[0] {
+		case "+", "M":
+			changed[rel(f[2])] = true
+		case "-":
+			deleted = append(deleted, rel(f[2]))
+		case "R":
+			if len(f) < 4 {
+				continue
+			}
+			deleted = append(deleted, rel(f[2]))
+			changed[rel(f[3])] = true
+			if f[1] == "/" {
+				renamed = append(renamed, rel(f[3]))
+			}
+		}
+	}
+	return changed, renamed, deleted
+}
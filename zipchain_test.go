@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseZfsDiff(t *testing.T) {
+	outputs := "M\t/\t/backup/g/s/d/\n" +
+		"+\tF\t/backup/g/s/d/new.txt\n" +
+		"M\tF\t/backup/g/s/d/docs/old\\0040file.txt\n" +
+		"-\tF\t/backup/g/s/d/gone.txt\n" +
+		"R\tF\t/backup/g/s/d/a.txt\t/backup/g/s/d/b.txt\n" +
+		"R\t/\t/backup/g/s/d/photos\t/backup/g/s/d/\\0320\\0244\\0320\\0276\\0321\\0202\\0320\\0276\n" +
+		"R\tF\t/backup/g/s/d/broken\n" +
+		"\n"
+	changed, renamed, deleted := parseZfsDiff(outputs, "/backup/g/s/d")
+	wantChanged := map[string]bool{
+		"":                  true,
+		"new.txt":           true,
+		"docs/old file.txt": true,
+		"b.txt":             true,
+		"Фото":              true,
+	}
+	if !reflect.DeepEqual(changed, wantChanged) {
+		t.Errorf("changed = %v, want %v", changed, wantChanged)
+	}
+	if want := []string{"Фото"}; !reflect.DeepEqual(renamed, want) {
+		t.Errorf("renamed = %q, want %q", renamed, want)
+	}
+	sort.Strings(deleted)
+	if want := []string{"a.txt", "gone.txt", "photos"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %q, want %q", deleted, want)
+	}
+}
+
+func TestIncrementalFilterMtime(t *testing.T) {
+	zipPath, snapPath := t.TempDir(), t.TempDir()
+	base := time.Now().Add(-time.Hour)
+	chain := zipChain{Dir: "g/s/d", Archives: []chainEntry{
+		{Name: "g_s_d_20261018d.zip", Snapshot: "20261018d", SnapCreation: base, Mode: "full"},
+	}}
+	if err := ioutil.WriteFile(filepath.Join(zipPath, "g_s_d_20261018d.zip"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	snap := managedSnap{snap: "20261019d", creation: time.Now()}
+	entry, include, warn := incrementalFilter("mtime", chain, zipPath, "pool/g/s/d", "/backup/g/s/d",
+		snapPath, snap, nil, defaultIncrementalChain)
+	if include == nil || warn != "" || entry.Mode != "mtime" || entry.Base != "20261018d" || entry.Note == "" {
+		t.Fatalf("incrementalFilter() = %+v, filter %t, warn %q, want mtime since '20261018d'",
+			entry, include != nil, warn)
+	}
+	// mtime of server kept by rsync is older than base snapshot, file is synced after it
+	synced := filepath.Join(snapPath, "synced.txt")
+	if err := ioutil.WriteFile(synced, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := base.Add(-time.Hour)
+	if err := os.Chtimes(synced, old, old); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(synced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !include(synced, info) {
+		t.Errorf("file with old mtime %s synced after base snapshot is not included", info.ModTime())
+	}
+	dirInfo, _ := os.Stat(snapPath)
+	if include(snapPath, dirInfo) {
+		t.Errorf("dir is included")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -8,52 +9,142 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/viper"
 )
 
 var (
-	task      string
-	checkonly bool   // Optional for task 'check'
-	group     string // Required for task 'sync'
-	cfgPath   string
+	task       string
+	checkonly  bool   // Optional for task 'check'
+	orphans    string // Optional for task 'check'
+	group      string // Name of backup group, list of groups for 'snap', 'diff', 'list', 'replicate', 'export', 'verifyzip'
+	hourly     bool   // Optional for task 'snap'
+	server     string // Required for task 'restore', 'mount', 'unmount', 'import'
+	dir        string // Required for task 'restore', 'mount', 'unmount', 'import'
+	snapshot   string // Optional for task 'restore', 'mount', 'unmount', 'zip'
+	subpath    string // Optional for task 'restore'
+	target     string // Required for task 'restore' without 'toorigin', 'import'. Optional for 'decrypt'
+	file       string // Required for task 'decrypt'
+	toorigin   bool   // Optional for task 'restore'
+	dryrun     bool   // Optional for task 'restore', 'import'
+	fullexport bool   // Optional for task 'export'
+	verify     bool   // Optional for task 'replicate'
+	jsonout    bool   // Optional for task 'list', 'check'
+	cfgPath    string
 )
 
-func init() {
+var tasks = []string{"check", "sync", "snap", "zip", "scrub", "diff", "restore", "list", "mount", "unmount", "replicate", "export", "import", "decrypt", "verifyzip"}
+
+// parseArgs reads command-line options and configuration,
+// not in init() for tests of package
+func parseArgs() {
 	/*
 		Read command-line options and set usage information
 	*/
 	flag.StringVar(&task, "task", "",
-		"Required. One of the options: check | sync | snap")
+		"Required. One of the options: "+strings.Join(tasks, " | "))
 	flag.BoolVar(&checkonly, "checkonly", true,
 		`Optional for task 'check'.
         Set 'false' for creating ZFS partitions from config`)
+	flag.StringVar(&orphans, "orphans", "report",
+		`Optional for task 'check'. Datasets under ZfsPath not found in config:
+        'report', 'rename' into 'OrphanPath' or 'destroy' after confirmation`)
 	flag.StringVar(&group, "group", "",
-		"Required. Name of backup group.")
+		`Required for tasks 'sync', 'zip', 'restore', 'mount', 'unmount', 'import'. Name of backup group.
+        Optional for tasks 'snap', 'diff', 'list', 'replicate', 'export' and 'verifyzip',
+        comma separated list of groups`)
+	flag.BoolVar(&hourly, "hourly", false,
+		`Optional for task 'snap'.
+        Make hourly snapshots 'YYYYMMDD-HHMMh', 'storageperiod.h' in hours`)
+	flag.StringVar(&server, "server", "",
+		"Required for tasks 'restore', 'mount', 'unmount', 'import'. Name of server in group.")
+	flag.StringVar(&dir, "dir", "",
+		"Required for tasks 'restore', 'mount', 'unmount', 'import'. Name of dir of server.")
+	flag.StringVar(&snapshot, "snapshot", "latest",
+		`Optional for tasks 'restore', 'mount', 'zip'. Snapshot name (20060102d),
+        date (20060102), 'before:20060102[-1504]' or 'latest'.
+        Optional for task 'unmount'. Snapshot name, default - all clones of dir`)
+	flag.StringVar(&subpath, "subpath", "",
+		"Optional for task 'restore'. Path inside snapshot, default - whole dir")
+	flag.StringVar(&target, "target", "",
+		`Required for task 'restore' without '-toorigin'. Local target path.
+        Required for task 'import'. Target dataset.
+        Optional for task 'decrypt'. Decrypted file, default - only test`)
+	flag.BoolVar(&toorigin, "toorigin", false,
+		`Optional for task 'restore'.
+        Restore to origin server with rsync and 'restoreargs' from config`)
+	flag.BoolVar(&dryrun, "dryrun", false,
+		"Optional for tasks 'restore', 'import'. Run without changes")
+	flag.BoolVar(&fullexport, "full", false,
+		"Optional for task 'export'. Full stream instead of incremental")
+	flag.BoolVar(&jsonout, "json", false,
+		"Optional for tasks 'list', 'check'. Output in JSON")
+	flag.BoolVar(&verify, "verify", false,
+		`Optional for task 'replicate'.
+        Compare snapshots of dirs with replica instead of replication`)
+	flag.StringVar(&file, "file", "",
+		"Required for task 'decrypt'. Archive file")
 	flag.Usage = func() {
 		fmt.Printf("Usage:\n")
-		fmt.Printf("  %s -task=check [-checkonly=false]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=check [-checkonly=false] [-orphans=report|rename|destroy] [-json]\n",
+			filepath.Base(os.Args[0]))
 		fmt.Printf("  %s -task=sync -group=<name>\n", filepath.Base(os.Args[0]))
-		fmt.Printf("  %s -task=snap\n\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=snap [-group=<name>[,<name>...]] [-hourly]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=zip -group=<name> [-snapshot=<name>]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=scrub\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=diff [-group=<name>[,<name>...]]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=restore -group=<name> -server=<name> -dir=<name>\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s     [-snapshot=<name>] [-subpath=<path>] -target=<path>|-toorigin [-dryrun]\n",
+			filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=list [-group=<name>[,<name>...]] [-json]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=mount|unmount -group=<name> -server=<name> -dir=<name> [-snapshot=<name>]\n",
+			filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=replicate [-group=<name>[,<name>...]] [-verify]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=export [-group=<name>[,<name>...]] [-full]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=import -group=<name> -server=<name> -dir=<name> -target=<dataset> [-dryrun]\n",
+			filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=decrypt -file=<archive> [-target=<file>]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("  %s -task=verifyzip [-group=<name>[,<name>...]]\n\n", filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 		fmt.Println("")
 	}
 	flag.Parse()
-	if task == "" || (task != "check" && task != "sync" && task != "snap" && task != "zip") {
-		fmt.Printf("task '%s' not set or not found\n", task)
+	exitWithUsage := func(msg string) {
+		fmt.Println(msg)
 		flag.Usage()
 		os.Exit(1)
 	}
-	if task == "sync" && group == "" {
-		fmt.Println("not set group for task 'sync'")
-		flag.Usage()
-		os.Exit(1)
+	knownTask := false
+	for _, t := range tasks {
+		knownTask = knownTask || task == t
 	}
-	if task == "zip" && group == "" {
-		fmt.Println("not set group for task 'sync'")
-		flag.Usage()
-		os.Exit(1)
+	if !knownTask {
+		exitWithUsage(fmt.Sprintf("task '%s' not set or not found", task))
+	}
+	if (task == "sync" || task == "zip" || task == "restore" || task == "mount" || task == "unmount" ||
+		task == "import") && group == "" {
+		exitWithUsage(fmt.Sprintf("not set group for task '%s'", task))
+	}
+	if (task == "restore" || task == "mount" || task == "unmount" || task == "import") &&
+		(server == "" || dir == "") {
+		exitWithUsage(fmt.Sprintf("not set server or dir for task '%s'", task))
+	}
+	if task == "restore" {
+		if (target == "" && !toorigin) || (target != "" && toorigin) {
+			exitWithUsage("set one of '-target' or '-toorigin' for task 'restore'")
+		}
+	}
+	if task == "import" && target == "" {
+		exitWithUsage("not set target dataset for task 'import'")
+	}
+	if task == "check" && orphans != "report" && orphans != "rename" && orphans != "destroy" {
+		exitWithUsage(fmt.Sprintf("unknown action '%s' for orphaned datasets", orphans))
+	}
+	if task == "decrypt" && file == "" {
+		exitWithUsage("not set archive file for task 'decrypt'")
 	}
 	/*
 		Read configuration
@@ -61,11 +152,17 @@ func init() {
 	cfgPath = filepath.Join("/etc", filepath.Base(os.Args[0]))
 	viper.SetConfigFile(filepath.Join(cfgPath, filepath.Base(os.Args[0])+".toml"))
 	if err := viper.ReadInConfig(); err != nil {
+		if task == "check" {
+			// diagnostics without panic trace
+			fmt.Printf("ERROR: read config: %s\n", err)
+			os.Exit(2)
+		}
 		panic(err)
 	}
 }
 
 func main() {
+	parseArgs()
 	if task != "check" {
 		logFileName := filepath.Join(
 			viper.GetString("LogPath"),
@@ -76,22 +173,67 @@ func main() {
 			panic(err)
 		}
 		defer logFile.Close()
-		log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+		if task == "list" {
+			// stdout for list only
+			log.SetOutput(logFile)
+		} else {
+			log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+		}
 	}
 
 	switch task {
 	case "check":
 		log.Println("INFO: Start task Check")
-		checkcreate()
+		if code := checkcreate(); code != 0 {
+			os.Exit(code)
+		}
 	case "sync":
 		log.Println("INFO: Start task Sync")
 		dorsync(group)
 	case "snap":
 		log.Println("INFO: Start task Snap")
-		dosnap()
+		dosnap(group)
 	case "zip":
 		log.Println("INFO: Start task Zip")
 		dozip(group)
+	case "scrub":
+		log.Println("INFO: Start task Scrub")
+		doscrub()
+	case "diff":
+		log.Println("INFO: Start task Diff")
+		dodiff(group)
+	case "restore":
+		log.Println("INFO: Start task Restore")
+		dorestore(group, server, dir)
+	case "list":
+		log.Println("INFO: Start task List")
+		dolist(group)
+	case "mount":
+		log.Println("INFO: Start task Mount")
+		domount(group, server, dir)
+	case "unmount":
+		log.Println("INFO: Start task Unmount")
+		dounmount(group, server, dir)
+	case "replicate":
+		if verify {
+			log.Println("INFO: Start task Replicate, verify")
+			doverify(group)
+		} else {
+			log.Println("INFO: Start task Replicate")
+			doreplicate(group)
+		}
+	case "export":
+		log.Println("INFO: Start task Export")
+		doexport(group)
+	case "import":
+		log.Println("INFO: Start task Import")
+		doimport(group, server, dir)
+	case "decrypt":
+		log.Println("INFO: Start task Decrypt")
+		dodecrypt(file)
+	case "verifyzip":
+		log.Println("INFO: Start task VerifyZip")
+		doverifyzip(group)
 	}
 
 	log.Println("INFO: Stop Successfull")
@@ -120,3 +262,41 @@ func getHostName() string {
 	}
 	return hostname
 }
+
+// zfsGetProps returns parsable values of ZFS properties of dataset 'name'
+// (zfs.Dataset.GetProperty always return "VALUE")
+func zfsGetProps(name string, props ...string) (map[string]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("zfs", "get", "-Hp", "-o", "property,value",
+		strings.Join(props, ","), name)
+	cmd.Stderr = &stderr
+	outputs, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", strings.TrimSpace(stderr.String()), err)
+	}
+	values := make(map[string]string)
+	for _, s := range strings.Split(string(outputs), "\n") {
+		if f := strings.Split(s, "\t"); len(f) == 2 {
+			values[f[0]] = f[1]
+		}
+	}
+	return values, nil
+}
+
+// propUint returns numeric value of property or 0
+func propUint(props map[string]string, key string) uint64 {
+	v, err := strconv.ParseUint(props[key], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// sizeMb returns size in Mb with one decimal place
+func sizeMb(size uint64) string {
+	s := humanize.Commaf(float64(size) / 1024 / 1024)
+	if strings.Contains(s, ".") {
+		return s[:(strings.Index(s, ".") + 2)]
+	}
+	return s + ".0"
+}